@@ -1,21 +1,19 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/am-silex/go_library/internal/data"
+	"github.com/am-silex/go_library/internal/validator"
 	"net/http"
-	"strconv"
 )
 
 func (app *application) createAuthorHandler(w http.ResponseWriter, r *http.Request) {
 
 	var inputData data.Author
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&inputData)
+	err := app.readJSON(w, r, &inputData)
 	if err != nil {
-		app.logger.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
@@ -26,10 +24,15 @@ func (app *application) createAuthorHandler(w http.ResponseWriter, r *http.Reque
 		DateOfBirth: inputData.DateOfBirth,
 	}
 
-	err = app.models.Authors.Insert(author, nil)
+	v := validator.New()
+	if data.ValidateAuthor(v, author); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Authors.Insert(r.Context(), author)
 	if err != nil {
-		app.logger.Println(err)
-		w.WriteHeader(http.StatusNoContent)
+		app.serverErrorResponse(w, r, err)
 		return
 	}
 	// When sending an HTTP response, we want to include a Location header to let
@@ -37,94 +40,309 @@ func (app *application) createAuthorHandler(w http.ResponseWriter, r *http.Reque
 	// make an empty http.Header map and then use the Set() method to add a new
 	// Location header, interpolating the system-generated ID for our new author
 	// in the URL.
-	w.Header().Set("Location", fmt.Sprintf("/authors/%d", author.ID))
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(author)
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/authors/%d", author.ID))
+	headers.Set("ETag", versionETag(author.Version))
 
+	err = app.writeJSON(w, http.StatusCreated, envelope{"author": author}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 func (app *application) updateAuthorHandler(w http.ResponseWriter, r *http.Request) {
 
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	author, err := app.models.Authors.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.ifMatch(r, author.Version) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
 	var inputData data.Author
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&inputData)
+	err = app.readJSON(w, r, &inputData)
 	if err != nil {
-		app.logger.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	author := &data.Author{
-		ID:          inputData.ID,
-		LastName:    inputData.LastName,
-		FirstName:   inputData.FirstName,
-		Bio:         inputData.Bio,
-		DateOfBirth: inputData.DateOfBirth,
+	// A version in the body must match too, for clients that don't send
+	// If-Match. Without either the update is still protected against
+	// changes made after the Get above.
+	if inputData.Version != 0 && inputData.Version != author.Version {
+		app.editConflictResponse(w, r)
+		return
 	}
 
-	err = app.models.Authors.Update(author, nil)
+	// The path is authoritative; an id in the body is ignored.
+	author.FirstName = inputData.FirstName
+	author.LastName = inputData.LastName
+	author.Bio = inputData.Bio
+	author.DateOfBirth = inputData.DateOfBirth
+
+	v := validator.New()
+	if data.ValidateAuthor(v, author); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Authors.Update(r.Context(), author)
 	if err != nil {
-		app.logger.Println(err)
-		w.WriteHeader(http.StatusNotFound)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
-	// When sending an HTTP response, we want to include a Location header to let
-	// the client know which URL they can find the newly-created resource at. We
-	// make an empty http.Header map and then use the Set() method to add a new
-	// Location header, interpolating the system-generated ID for our new author
-	// in the URL.
-	w.Header().Set("Location", fmt.Sprintf("/authors/%d", author.ID))
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(author)
+
+	headers := make(http.Header)
+	headers.Set("ETag", versionETag(author.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"author": author}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// partialUpdateAuthorHandler changes only the fields present in the body.
+// A null keeps the current value, except in a JSON merge patch, sent as
+// application/merge-patch+json, where it resets the field.
+func (app *application) partialUpdateAuthorHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	author, err := app.models.Authors.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.ifMatch(r, author.Version) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	var inputData struct {
+		FirstName   *string `json:"first_name"`
+		LastName    *string `json:"last_name"`
+		Bio         *string `json:"bio"`
+		DateOfBirth *int    `json:"date_of_birth"`
+		Version     *int    `json:"version"`
+	}
+	nulls, err := app.readPatch(w, r, &inputData)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if inputData.Version != nil && *inputData.Version != author.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	patch(&author.FirstName, inputData.FirstName, nulls["first_name"])
+	patch(&author.LastName, inputData.LastName, nulls["last_name"])
+	patch(&author.Bio, inputData.Bio, nulls["bio"])
+	patch(&author.DateOfBirth, inputData.DateOfBirth, nulls["date_of_birth"])
+
+	v := validator.New()
+	if data.ValidateAuthor(v, author); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Authors.Update(r.Context(), author)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", versionETag(author.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"author": author}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 func (app *application) deleteAuthorHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
-	if err != nil || id < 1 {
+
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
-	err = app.models.Authors.Delete(id, nil)
+
+	err = app.models.Authors.Delete(r.Context(), id)
 	if err != nil {
-		app.logger.Println(err)
-		w.WriteHeader(http.StatusNoContent)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrAuthorHasBooks):
+			app.errorResponse(w, r, http.StatusConflict, "the author still has books, delete or reassign them first")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("author successfully deleted"))
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "author successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 func (app *application) getAuthorHandler(w http.ResponseWriter, r *http.Request) {
 
-	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
-	if err != nil || id < 1 {
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
-	author, err := app.models.Authors.Get(id)
+
+	author, err := app.models.Authors.Get(r.Context(), id)
 	if err != nil {
-		app.logger.Println(err)
-		w.WriteHeader(http.StatusNotFound)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(author)
+	headers := make(http.Header)
+	headers.Set("ETag", versionETag(author.Version))
 
+	err = app.writeJSON(w, http.StatusOK, envelope{"author": author}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 func (app *application) listAuthorsHandler(w http.ResponseWriter, r *http.Request) {
 
-	authors, err := app.models.Authors.GetAll()
+	var input struct {
+		Name     string
+		BornFrom int
+		BornTo   int
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Name = app.readString(qs, "name", "")
+	input.BornFrom = app.readInt(qs, "born_from", 0, v)
+	input.BornTo = app.readInt(qs, "born_to", 0, v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "last_name")
+	input.Filters.SortColumns = data.AuthorSortColumns
+
+	v.Check(input.BornTo == 0 || input.BornFrom <= input.BornTo, "born_to", "must not be before born_from")
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	authors, metadata, err := app.models.Authors.GetAll(r.Context(), input.Name, input.BornFrom, input.BornTo, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"authors": authors, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listAuthorBooksHandler lists the books an author is credited on, in any
+// role. It accepts the pagination, sort and include parameters of
+// listBooksHandler.
+func (app *application) listAuthorBooksHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	var input struct {
+		Include data.BookInclude
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Include = data.ParseBookInclude(v, app.readString(qs, "include", ""))
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "title")
+	input.Filters.SortColumns = data.BookSortColumns
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// An unknown author is a 404 rather than an empty list.
+	_, err = app.models.Authors.Get(r.Context(), id)
 	if err != nil {
-		app.logger.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(authors)
+	books, metadata, err := app.models.Books.GetAll(r.Context(), "", int(id), 0, 0, input.Filters, input.Include)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"books": books, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
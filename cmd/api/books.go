@@ -1,21 +1,20 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/am-silex/go_library/internal/data"
+	"github.com/am-silex/go_library/internal/validator"
 	"net/http"
-	"strconv"
 )
 
 func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request) {
 
 	var inputData data.Book
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&inputData)
+	err := app.readJSON(w, r, &inputData)
 	if err != nil {
-		app.logger.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
@@ -26,11 +25,31 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 		ISBN:     inputData.ISBN,
 	}
 
-	err = app.models.Books.Insert(book, nil)
+	v := validator.New()
+	data.ValidateBook(v, book)
+	err = app.validateBookAuthor(r.Context(), v, book)
 	if err != nil {
-		app.logger.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("book wasn't created"))
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Books.Insert(r.Context(), book)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateISBN):
+			v.AddError("isbn", "a book with this ISBN already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrAuthorNotFound):
+			// The author was deleted since validateBookAuthor checked it.
+			v.AddError("author_id", "must reference an existing author")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 	// When sending an HTTP response, we want to include a Location header to let
@@ -38,99 +57,415 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 	// make an empty http.Header map and then use the Set() method to add a new
 	// Location header, interpolating the system-generated ID for our new book
 	// in the URL.
-	w.Header().Set("Location", fmt.Sprintf("/books/%d", book.ID))
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(book)
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/books/%d", book.ID))
+	headers.Set("ETag", versionETag(book.Version))
 
+	err = app.writeJSON(w, http.StatusCreated, envelope{"book": book}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request) {
 
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	book, err := app.models.Books.Get(r.Context(), id, data.BookInclude{})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.ifMatch(r, book.Version) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
 	var inputData data.Book
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&inputData)
+	err = app.readJSON(w, r, &inputData)
 	if err != nil {
-		app.logger.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	book := &data.Book{
-		ID:       inputData.ID,
-		Title:    inputData.Title,
-		AuthorID: inputData.AuthorID,
-		Year:     inputData.Year,
-		ISBN:     inputData.ISBN,
+	// A version in the body must match too, for clients that don't send
+	// If-Match. Without either the update is still protected against
+	// changes made after the Get above.
+	if inputData.Version != 0 && inputData.Version != book.Version {
+		app.editConflictResponse(w, r)
+		return
 	}
 
-	err = app.models.Books.Update(book, nil)
+	// The path is authoritative; an id in the body is ignored.
+	book.Title = inputData.Title
+	book.AuthorID = inputData.AuthorID
+	book.Year = inputData.Year
+	book.ISBN = inputData.ISBN
+
+	v := validator.New()
+	data.ValidateBook(v, book)
+	err = app.validateBookAuthor(r.Context(), v, book)
 	if err != nil {
-		app.logger.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("book wasn't updated"))
+		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// When sending an HTTP response, we want to include a Location header to let
-	// the client know which URL they can find the newly-created resource at. We
-	// make an empty http.Header map and then use the Set() method to add a new
-	// Location header, interpolating the system-generated ID for our new book
-	// in the URL.
-	w.Header().Set("Location", fmt.Sprintf("/books/%d", book.ID))
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(book)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Books.Update(r.Context(), book)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateISBN):
+			v.AddError("isbn", "a book with this ISBN already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrAuthorNotFound):
+			// The author was deleted since validateBookAuthor checked it.
+			v.AddError("author_id", "must reference an existing author")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateBookAuthor):
+			v.AddError("author_id", "is already one of the book's authors, use PUT /v1/books/{id}/authors")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", versionETag(book.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// partialUpdateBookHandler changes only the fields present in the body.
+// A null keeps the current value, except in a JSON merge patch, sent as
+// application/merge-patch+json, where it resets the field.
+func (app *application) partialUpdateBookHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	book, err := app.models.Books.Get(r.Context(), id, data.BookInclude{})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.ifMatch(r, book.Version) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	var inputData struct {
+		Title    *string `json:"title"`
+		AuthorID *int    `json:"author_id"`
+		Year     *int    `json:"year"`
+		ISBN     *string `json:"isbn"`
+		Version  *int    `json:"version"`
+	}
+	nulls, err := app.readPatch(w, r, &inputData)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if inputData.Version != nil && *inputData.Version != book.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	patch(&book.Title, inputData.Title, nulls["title"])
+	patch(&book.AuthorID, inputData.AuthorID, nulls["author_id"])
+	patch(&book.Year, inputData.Year, nulls["year"])
+	patch(&book.ISBN, inputData.ISBN, nulls["isbn"])
+
+	v := validator.New()
+	data.ValidateBook(v, book)
+	err = app.validateBookAuthor(r.Context(), v, book)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Books.Update(r.Context(), book)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateISBN):
+			v.AddError("isbn", "a book with this ISBN already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrAuthorNotFound):
+			// The author was deleted since validateBookAuthor checked it.
+			v.AddError("author_id", "must reference an existing author")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateBookAuthor):
+			v.AddError("author_id", "is already one of the book's authors, use PUT /v1/books/{id}/authors")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", versionETag(book.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 func (app *application) deleteBookHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
-	if err != nil || id < 1 {
-		w.WriteHeader(http.StatusBadRequest)
+
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
-	err = app.models.Books.Delete(id, nil)
+
+	err = app.models.Books.Delete(r.Context(), id)
 	if err != nil {
-		app.logger.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("book wasn't deleted"))
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("book successfully deleted"))
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "book successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 func (app *application) getBookHandler(w http.ResponseWriter, r *http.Request) {
 
-	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
-	if err != nil || id < 1 {
-		w.WriteHeader(http.StatusBadRequest)
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	include := data.ParseBookInclude(v, app.readString(r.URL.Query(), "include", ""))
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	book, err := app.models.Books.Get(id)
+
+	book, err := app.models.Books.Get(r.Context(), id, include)
 	if err != nil {
-		app.logger.Println(err)
-		w.Write([]byte("book not found"))
-		w.WriteHeader(http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(book)
+	// Like every book response, an expanded one is tagged with the book's
+	// version, which is what If-Match compares.
+	headers := make(http.Header)
+	headers.Set("ETag", versionETag(book.Version))
 
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 func (app *application) listBooksHandler(w http.ResponseWriter, r *http.Request) {
 
-	books, err := app.models.Books.GetAll()
+	var input struct {
+		Title    string
+		AuthorID int
+		YearFrom int
+		YearTo   int
+		Include  data.BookInclude
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Title = app.readString(qs, "title", "")
+	input.AuthorID = app.readInt(qs, "author_id", 0, v)
+	input.YearFrom = app.readInt(qs, "year_from", 0, v)
+	input.YearTo = app.readInt(qs, "year_to", 0, v)
+	input.Include = data.ParseBookInclude(v, app.readString(qs, "include", ""))
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "title")
+	input.Filters.SortColumns = data.BookSortColumns
+
+	v.Check(input.YearTo == 0 || input.YearFrom <= input.YearTo, "year_to", "must not be before year_from")
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	books, metadata, err := app.models.Books.GetAll(r.Context(), input.Title, input.AuthorID, input.YearFrom, input.YearTo, input.Filters, input.Include)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"books": books, "metadata": metadata}, nil)
 	if err != nil {
-		app.logger.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// setBookAuthorsHandler replaces the authors of a book. The first entry
+// with the author role becomes the book's primary author, its author_id.
+func (app *application) setBookAuthorsHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(books)
+	book, err := app.models.Books.Get(r.Context(), id, data.BookInclude{})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.ifMatch(r, book.Version) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	var inputData struct {
+		Authors []data.BookAuthor `json:"authors"`
+		Version int               `json:"version"`
+	}
+	err = app.readJSON(w, r, &inputData)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if inputData.Version != 0 && inputData.Version != book.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	// Names are read from the authors table, a role defaults to author.
+	authors := make([]data.BookAuthor, len(inputData.Authors))
+	for i, input := range inputData.Authors {
+		authors[i] = data.BookAuthor{ID: input.ID, Role: input.Role}
+		if authors[i].Role == "" {
+			authors[i].Role = data.RoleAuthor
+		}
+	}
+
+	v := validator.New()
+	data.ValidateBookAuthors(v, authors)
+	for i, author := range authors {
+		key := fmt.Sprintf("authors[%d].id", i)
+		if _, exists := v.Errors[key]; exists {
+			continue
+		}
+
+		_, err := app.models.Authors.Get(r.Context(), int64(author.ID))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError(key, "must reference an existing author")
+			default:
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Books.SetAuthors(r.Context(), book, authors)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrAuthorNotFound):
+			// An author was deleted since it was checked above.
+			v.AddError("authors", "must reference existing authors")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", versionETag(book.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// validateBookAuthor records a validation error when the book's author_id
+// doesn't reference an existing author. Only unexpected errors are returned.
+func (app *application) validateBookAuthor(ctx context.Context, v *validator.Validator, book *data.Book) error {
+	if _, exists := v.Errors["author_id"]; exists {
+		return nil
+	}
+
+	_, err := app.models.Authors.Get(ctx, int64(book.AuthorID))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("author_id", "must reference an existing author")
+		default:
+			return err
+		}
+	}
+
+	return nil
 }
@@ -1,11 +1,11 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/am-silex/go_library/internal/data"
+	"github.com/am-silex/go_library/internal/validator"
 	"net/http"
-	"strconv"
 )
 
 func (app *application) updateBookAndAuthorHandler(w http.ResponseWriter, r *http.Request) {
@@ -15,71 +15,241 @@ func (app *application) updateBookAndAuthorHandler(w http.ResponseWriter, r *htt
 		Book   data.Book   `json:"book"`
 		Author data.Author `json:"author"`
 	}
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&inputData)
+	err := app.readJSON(w, r, &inputData)
 	if err != nil {
-		app.logger.Println(err)
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	authorId, err := strconv.Atoi(r.PathValue("author_id"))
-	if err != nil || authorId < 1 {
+	authorId, err := app.readIDParam(r, "author_id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	bookId, err := strconv.Atoi(r.PathValue("book_id"))
-	if err != nil || bookId < 1 {
+	bookId, err := app.readIDParam(r, "book_id")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	tx, err := app.models.Translations.Create()
-	defer func() {
-		if err == nil {
-			err = app.models.Translations.Commit(tx)
-			if err != nil {
-				app.logger.Println(err)
-			}
+	author, err := app.models.Authors.Get(r.Context(), authorId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	book, err := app.models.Books.Get(r.Context(), bookId, data.BookInclude{})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
+		return
+	}
+
+	// Versions sent by the client must still be current; without them the
+	// updates are checked against the versions read above.
+	if (inputData.Author.Version != 0 && inputData.Author.Version != author.Version) ||
+		(inputData.Book.Version != 0 && inputData.Book.Version != book.Version) {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	author.FirstName = inputData.Author.FirstName
+	author.LastName = inputData.Author.LastName
+	author.Bio = inputData.Author.Bio
+	author.DateOfBirth = inputData.Author.DateOfBirth
+
+	// The book ends up with the author in the path: it either belongs to
+	// them already or is reassigned to them, in which case the payload
+	// must say so. Moving it to a third author isn't done here.
+	currentAuthorID := book.AuthorID
+
+	book.Title = inputData.Book.Title
+	book.AuthorID = author.ID
+	book.Year = inputData.Book.Year
+	book.ISBN = inputData.Book.ISBN
+
+	// Field names are prefixed with the entity, so the client can tell
+	// which half of the payload is wrong.
+	vAuthor := validator.New()
+	data.ValidateAuthor(vAuthor, author)
+	vBook := validator.New()
+	data.ValidateBook(vBook, book)
+	vBook.Check(inputData.Book.AuthorID == 0 || inputData.Book.AuthorID == author.ID,
+		"author_id", "must be the author in the URL")
+	vBook.Check(currentAuthorID == author.ID || inputData.Book.AuthorID == author.ID,
+		"author_id", "the book belongs to another author, set author_id to reassign it")
+
+	v := validator.New()
+	for key, message := range vAuthor.Errors {
+		v.AddError("author."+key, message)
+	}
+	for key, message := range vBook.Errors {
+		v.AddError("book."+key, message)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Both updates are committed together or not at all.
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		// Work on copies, so that a retried attempt starts again from the
+		// versions read above.
+		a, b := *author, *book
+
+		err := tx.Authors.Update(r.Context(), &a)
 		if err != nil {
-			err = app.models.Translations.Rollback(tx)
-			if err != nil {
-				app.logger.Println(err)
-			}
+			return err
 		}
-	}()
+
+		err = tx.Books.Update(r.Context(), &b)
+		if err != nil {
+			return err
+		}
+
+		*author, *book = a, b
+		return nil
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateISBN):
+			v.AddError("book.isbn", "a book with this ISBN already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateBookAuthor):
+			v.AddError("book.author_id", "is already one of the book's authors, use PUT /v1/books/{id}/authors")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"author": author, "book": book}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createAuthorWithBooksHandler creates an author together with their books,
+// in one transaction: either all of them are created or none.
+func (app *application) createAuthorWithBooksHandler(w http.ResponseWriter, r *http.Request) {
+
+	var inputData struct {
+		Author data.Author `json:"author"`
+		Books  []data.Book `json:"books"`
+	}
+	err := app.readJSON(w, r, &inputData)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
 
 	author := &data.Author{
-		ID:          authorId,
 		FirstName:   inputData.Author.FirstName,
 		LastName:    inputData.Author.LastName,
 		Bio:         inputData.Author.Bio,
 		DateOfBirth: inputData.Author.DateOfBirth,
 	}
-	err = app.models.Authors.Update(author, tx)
-	if err != nil {
-		app.logger.Println(err)
-		return
+
+	books := make([]*data.Book, len(inputData.Books))
+	for i, input := range inputData.Books {
+		books[i] = &data.Book{
+			Title: input.Title,
+			Year:  input.Year,
+			ISBN:  input.ISBN,
+		}
 	}
 
-	book := &data.Book{
-		ID:       bookId,
-		Title:    inputData.Book.Title,
-		AuthorID: inputData.Book.AuthorID,
-		Year:     inputData.Book.Year,
-		ISBN:     inputData.Book.ISBN,
+	// Field names are prefixed with the entity, books with their index in
+	// the payload, e.g. "books[1].isbn".
+	v := validator.New()
+
+	vAuthor := validator.New()
+	data.ValidateAuthor(vAuthor, author)
+	for key, message := range vAuthor.Errors {
+		v.AddError("author."+key, message)
 	}
-	err = app.models.Books.Update(book, tx)
+
+	v.Check(len(books) > 0, "books", "must contain at least one book")
+	v.Check(len(books) <= 100, "books", "must not contain more than 100 books")
+
+	isbns := make(map[string]int)
+	for i, book := range books {
+		vBook := validator.New()
+		data.ValidateBook(vBook, book)
+		// The author_id is only known once the author is inserted.
+		delete(vBook.Errors, "author_id")
+
+		vBook.Check(inputData.Books[i].AuthorID == 0, "author_id", "must not be provided, books belong to the new author")
+
+		isbn := validator.NormalizeISBN(book.ISBN)
+		if first, exists := isbns[isbn]; exists && isbn != "" {
+			vBook.AddError("isbn", fmt.Sprintf("duplicates the ISBN of books[%d]", first))
+		} else {
+			isbns[isbn] = i
+		}
+
+		for key, message := range vBook.Errors {
+			v.AddError(fmt.Sprintf("books[%d].%s", i, key), message)
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// failed is the index of the book whose insert failed, to point the
+	// client at it on a duplicate ISBN.
+	failed := -1
+
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.Authors.Insert(r.Context(), author)
+		if err != nil {
+			return err
+		}
+
+		for i, book := range books {
+			book.AuthorID = author.ID
+
+			err = tx.Books.Insert(r.Context(), book)
+			if err != nil {
+				failed = i
+				return err
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
-		app.logger.Println(err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateISBN):
+			v.AddError(fmt.Sprintf("books[%d].isbn", failed), "a book with this ISBN already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	// When sending an HTTP response, we want to include a Location header to let
-	// the client know which URL they can find the newly-created resource at. We
-	// make an empty http.Header map and then use the Set() method to add a new
-	// Location header, interpolating the system-generated ID for our new book
-	// in the URL.
-	w.Header().Set("Location", fmt.Sprintf("/books/%d/authors/%d", bookId, authorId))
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/authors/%d", author.ID))
+	headers.Set("ETag", versionETag(author.Version))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"author": author, "books": books}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/am-silex/go_library/internal/validator"
+	"gopkg.in/yaml.v3"
+)
+
+// setting describes a single configuration value. Each setting can be given,
+// in increasing order of precedence, as a default, in the YAML config file
+// (nested, e.g. db: {host: ...}), as an environment variable (DB_HOST) or as
+// a command-line flag (-db-host).
+type setting struct {
+	name         string
+	usage        string
+	defaultValue string
+	secret       bool
+	set          func(cfg *config, value string) error
+}
+
+// env returns the name of the environment variable for the setting.
+func (s setting) env() string {
+	return strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+var settings = []setting{
+	{name: "app-env", usage: "environment name (development, staging, production)", defaultValue: "development",
+		set: func(cfg *config, v string) error { cfg.env = v; return nil }},
+	{name: "log-level", usage: "minimum log level (debug, info, warn, error)", defaultValue: "info",
+		set: func(cfg *config, v string) error { return parseLevel(v, &cfg.logLevel) }},
+
+	{name: "db-host", usage: "PostgreSQL host", defaultValue: "localhost",
+		set: func(cfg *config, v string) error { cfg.dbHost = v; return nil }},
+	{name: "db-port", usage: "PostgreSQL port", defaultValue: "5432",
+		set: func(cfg *config, v string) error { return parseInt(v, &cfg.dbPort) }},
+	{name: "db-user", usage: "PostgreSQL user", defaultValue: "postgres",
+		set: func(cfg *config, v string) error { cfg.dbUser = v; return nil }},
+	{name: "db-pass", usage: "PostgreSQL password", secret: true,
+		set: func(cfg *config, v string) error { cfg.dbPass = v; return nil }},
+	{name: "db-name", usage: "PostgreSQL database name", defaultValue: "library",
+		set: func(cfg *config, v string) error { cfg.dbName = v; return nil }},
+	{name: "db-sslmode", usage: "PostgreSQL SSL mode (disable, allow, prefer, require, verify-ca, verify-full)", defaultValue: "disable",
+		set: func(cfg *config, v string) error { cfg.dbSSLMode = v; return nil }},
+	{name: "db-sslrootcert", usage: "path to the CA certificate used to verify the PostgreSQL server",
+		set: func(cfg *config, v string) error { cfg.dbSSLRootCert = v; return nil }},
+	{name: "db-application-name", usage: "application_name reported to PostgreSQL", defaultValue: "library-api",
+		set: func(cfg *config, v string) error { cfg.dbApplicationName = v; return nil }},
+	{name: "db-statement-timeout", usage: "PostgreSQL statement_timeout, 0 for none", defaultValue: "30s",
+		set: func(cfg *config, v string) error { return parseDuration(v, &cfg.dbStatementTimeout) }},
+	{name: "db-query-timeout", usage: "default time limit of a single query made by the API", defaultValue: "3s",
+		set: func(cfg *config, v string) error { return parseDuration(v, &cfg.dbQueryTimeout) }},
+	{name: "db-max-open-conns", usage: "maximum number of open PostgreSQL connections", defaultValue: "25",
+		set: func(cfg *config, v string) error { return parseInt(v, &cfg.dbMaxOpenConns) }},
+	{name: "db-max-idle-conns", usage: "maximum number of idle PostgreSQL connections", defaultValue: "25",
+		set: func(cfg *config, v string) error { return parseInt(v, &cfg.dbMaxIdleConns) }},
+	{name: "db-max-idle-time", usage: "how long a PostgreSQL connection may stay idle", defaultValue: "15m",
+		set: func(cfg *config, v string) error { return parseDuration(v, &cfg.dbMaxIdleTime) }},
+	{name: "db-connect-timeout", usage: "how long to retry connecting to PostgreSQL on startup", defaultValue: "30s",
+		set: func(cfg *config, v string) error { return parseDuration(v, &cfg.dbConnectTimeout) }},
+
+	{name: "cors-trusted-origins", usage: "comma-separated origins allowed to make cross-origin requests",
+		set: func(cfg *config, v string) error { return parseOrigins(v, &cfg.corsTrustedOrigins) }},
+
+	{name: "limiter-enabled", usage: "enable per-client rate limiting", defaultValue: "true",
+		set: func(cfg *config, v string) error { return parseBool(v, &cfg.limiterEnabled) }},
+	{name: "limiter-rps", usage: "rate limiter maximum requests per second per client", defaultValue: "2",
+		set: func(cfg *config, v string) error { return parseFloat(v, &cfg.limiterRPS) }},
+	{name: "limiter-burst", usage: "rate limiter maximum burst per client", defaultValue: "4",
+		set: func(cfg *config, v string) error { return parseInt(v, &cfg.limiterBurst) }},
+	{name: "limiter-trusted-proxies", usage: "comma-separated IPs or CIDRs of proxies whose X-Forwarded-For is trusted",
+		set: func(cfg *config, v string) error { return parsePrefixes(v, &cfg.limiterTrustedProxies) }},
+
+	{name: "web-host", usage: "HTTP listen host, empty for all interfaces",
+		set: func(cfg *config, v string) error { cfg.webHost = v; return nil }},
+	{name: "web-port", usage: "HTTP listen port", defaultValue: "8080",
+		set: func(cfg *config, v string) error { return parseInt(v, &cfg.webPort) }},
+	{name: "web-read-timeout", usage: "HTTP server read timeout", defaultValue: "5s",
+		set: func(cfg *config, v string) error { return parseDuration(v, &cfg.webReadTimeout) }},
+	{name: "web-write-timeout", usage: "HTTP server write timeout", defaultValue: "10s",
+		set: func(cfg *config, v string) error { return parseDuration(v, &cfg.webWriteTimeout) }},
+	{name: "web-idle-timeout", usage: "HTTP server idle timeout", defaultValue: "1m",
+		set: func(cfg *config, v string) error { return parseDuration(v, &cfg.webIdleTimeout) }},
+	{name: "web-shutdown-timeout", usage: "time allowed for in-flight requests on shutdown", defaultValue: "30s",
+		set: func(cfg *config, v string) error { return parseDuration(v, &cfg.webShutdownTimeout) }},
+}
+
+func parseInt(v string, dst *int) error {
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("must be an integer, got %q", v)
+	}
+	*dst = i
+	return nil
+}
+
+func parseBool(v string, dst *bool) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("must be true or false, got %q", v)
+	}
+	*dst = b
+	return nil
+}
+
+func parseFloat(v string, dst *float64) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("must be a number, got %q", v)
+	}
+	*dst = f
+	return nil
+}
+
+// parseOrigins parses a comma-separated list of origins such as
+// https://catalog.example.com. Origins are compared verbatim with the
+// Origin header, so paths and trailing slashes are rejected.
+func parseOrigins(v string, dst *[]string) error {
+	var origins []string
+
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		u, err := url.Parse(part)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Errorf("must be a list of origins such as https://example.com, got %q", part)
+		}
+		origins = append(origins, part)
+	}
+
+	*dst = origins
+	return nil
+}
+
+// parsePrefixes parses a comma-separated list of IP addresses and CIDR
+// ranges. A bare address is treated as a single-address range.
+func parsePrefixes(v string, dst *[]netip.Prefix) error {
+	var prefixes []netip.Prefix
+
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if addr, err := netip.ParseAddr(part); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(part)
+		if err != nil {
+			return fmt.Errorf("must be a list of IP addresses or CIDR ranges, got %q", part)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	*dst = prefixes
+	return nil
+}
+
+func parseDuration(v string, dst *time.Duration) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("must be a duration such as 5s or 1m, got %q", v)
+	}
+	*dst = d
+	return nil
+}
+
+func parseLevel(v string, dst *slog.Level) error {
+	err := dst.UnmarshalText([]byte(v))
+	if err != nil {
+		return fmt.Errorf("must be one of debug, info, warn, error, got %q", v)
+	}
+	return nil
+}
+
+// rawValue is the winning value of a setting and where it came from.
+type rawValue struct {
+	value  string
+	source string
+}
+
+// configApp builds app.config from the defaults, the config file, the
+// environment and the command-line args, in that order. It returns the
+// arguments left after the flags (the subcommand, if any). Every invalid
+// setting is reported in the returned error, not just the first one.
+func configApp(app *application, args []string) ([]string, error) {
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	fs.BoolVar(&app.config.showVersion, "version", false, "print the version and exit")
+	fs.BoolVar(&app.config.printConfig, "print-config", false, "print the effective configuration, with secrets redacted, and exit")
+
+	flagValues := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flagValues[s.name] = fs.String(s.name, s.defaultValue, fmt.Sprintf("%s (env %s)", s.usage, s.env()))
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]rawValue, len(settings))
+	for _, s := range settings {
+		raw[s.name] = rawValue{value: s.defaultValue, source: "default"}
+	}
+
+	var problems []string
+
+	if *configFile != "" {
+		fileValues, err := readConfigFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range fileValues {
+			if _, ok := raw[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: unknown setting %q", *configFile, name))
+				continue
+			}
+			raw[name] = rawValue{value: value, source: *configFile}
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env()); ok {
+			raw[s.name] = rawValue{value: value, source: "env " + s.env()}
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if value, ok := flagValues[f.Name]; ok {
+			raw[f.Name] = rawValue{value: *value, source: "flag -" + f.Name}
+		}
+	})
+
+	unparsed := make(map[string]bool)
+	for _, s := range settings {
+		if err := s.set(&app.config, raw[s.name].value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (%s): %s", s.name, raw[s.name].source, err))
+			unparsed[s.name] = true
+		}
+	}
+
+	app.config.sources = raw
+
+	problems = append(problems, validateConfig(app.config, unparsed)...)
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return fs.Args(), nil
+}
+
+// validateConfig checks the parsed values and describes every problem.
+// Settings in unparsed already have a problem reported and are skipped.
+func validateConfig(cfg config, unparsed map[string]bool) []string {
+	var problems []string
+
+	check := func(ok bool, name, message string) {
+		if !ok && !unparsed[name] {
+			problems = append(problems, fmt.Sprintf("%s (%s): %s", name, cfg.sources[name].source, message))
+		}
+	}
+
+	check(validator.PermittedValue(cfg.env, "development", "staging", "production"),
+		"app-env", "must be one of development, staging, production")
+
+	check(cfg.dbHost != "", "db-host", "must be provided")
+	check(cfg.dbPort > 0 && cfg.dbPort <= 65535, "db-port", "must be between 1 and 65535")
+	check(cfg.dbUser != "", "db-user", "must be provided")
+	check(cfg.dbName != "", "db-name", "must be provided")
+	check(validator.PermittedValue(cfg.dbSSLMode, "disable", "allow", "prefer", "require", "verify-ca", "verify-full"),
+		"db-sslmode", "must be one of disable, allow, prefer, require, verify-ca, verify-full")
+	check(cfg.dbStatementTimeout >= 0, "db-statement-timeout", "must not be negative")
+	check(cfg.dbQueryTimeout > 0, "db-query-timeout", "must be greater than zero")
+	check(cfg.dbMaxOpenConns > 0, "db-max-open-conns", "must be greater than zero")
+	check(cfg.dbMaxIdleConns >= 0, "db-max-idle-conns", "must not be negative")
+	check(cfg.dbMaxIdleConns <= cfg.dbMaxOpenConns, "db-max-idle-conns", "must not be greater than db-max-open-conns")
+	check(cfg.dbMaxIdleTime >= 0, "db-max-idle-time", "must not be negative")
+	check(cfg.dbConnectTimeout >= 0, "db-connect-timeout", "must not be negative")
+
+	check(cfg.limiterRPS > 0, "limiter-rps", "must be greater than zero")
+	check(cfg.limiterBurst > 0, "limiter-burst", "must be greater than zero")
+
+	check(cfg.webPort > 0 && cfg.webPort <= 65535, "web-port", "must be between 1 and 65535")
+	check(cfg.webReadTimeout > 0, "web-read-timeout", "must be greater than zero")
+	check(cfg.webWriteTimeout > 0, "web-write-timeout", "must be greater than zero")
+	check(cfg.webIdleTimeout > 0, "web-idle-timeout", "must be greater than zero")
+	check(cfg.webShutdownTimeout > 0, "web-shutdown-timeout", "must be greater than zero")
+
+	return problems
+}
+
+// readConfigFile reads a YAML file and flattens nested keys into setting
+// names, so that db: {host: x} yields "db-host" = "x".
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+
+	var doc map[string]interface{}
+	err = yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	err = flattenConfig("", doc, values)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return values, nil
+}
+
+// flattenConfig adds the scalars under node to values. Lists are joined with
+// commas, the separator the list settings are parsed with.
+func flattenConfig(prefix string, node map[string]interface{}, values map[string]string) error {
+	for key, value := range node {
+		name := strings.ReplaceAll(strings.ToLower(key), "_", "-")
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			err := flattenConfig(name, v, values)
+			if err != nil {
+				return err
+			}
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				switch item.(type) {
+				case map[string]interface{}, []interface{}:
+					return fmt.Errorf("%s: list items must be plain values", name)
+				}
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+
+	return nil
+}
+
+// printConfig writes the effective configuration as YAML, in the format
+// accepted by -config, with secrets redacted.
+func (app *application) printConfig(w io.Writer) error {
+	doc := make(map[string]interface{})
+
+	for _, s := range settings {
+		value := app.config.sources[s.name].value
+		if s.secret && value != "" {
+			value = "REDACTED"
+		}
+
+		section, key, _ := strings.Cut(s.name, "-")
+		if doc[section] == nil {
+			doc[section] = make(map[string]string)
+		}
+		doc[section].(map[string]string)[key] = value
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	defer enc.Close()
+
+	return enc.Encode(doc)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"github.com/am-silex/go_library/internal/data"
+	"net/http"
+)
+
+// contextKey Define a custom type for request context keys, so that they
+// can't collide with keys set by other packages.
+type contextKey string
+
+const (
+	userContextKey        = contextKey("user")
+	requestIDContextKey   = contextKey("request_id")
+	requestUserContextKey = contextKey("request_user")
+)
+
+// requestUser is filled in by contextSetUser, so that middleware running
+// before authHandler (the access log) can see who made the request.
+type requestUser struct {
+	user *data.User
+}
+
+// contextSetUser returns a new copy of the request with the provided User
+// struct added to the context.
+func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	if holder, ok := r.Context().Value(requestUserContextKey).(*requestUser); ok {
+		holder.user = user
+	}
+
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// contextGetUser retrieves the User struct from the request context. It is
+// only called when a User is expected to be there, so a missing value is a
+// programming error.
+func (app *application) contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+
+	return user
+}
+
+// contextSetRequestUser returns a new copy of the request carrying the
+// holder that contextSetUser reports the user to.
+func (app *application) contextSetRequestUser(r *http.Request, holder *requestUser) *http.Request {
+	ctx := context.WithValue(r.Context(), requestUserContextKey, holder)
+	return r.WithContext(ctx)
+}
+
+// contextSetRequestID returns a new copy of the request with the request ID
+// added to the context.
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID retrieves the request ID from the request context, or
+// "" outside of a request.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
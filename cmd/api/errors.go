@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"github.com/am-silex/go_library/internal/data"
+	"net/http"
+	"strconv"
+)
+
+// logError logs an error along with the request ID and the request it
+// happened in.
+func (app *application) logError(r *http.Request, err error) {
+	app.logger.Error(err.Error(),
+		"request_id", app.contextGetRequestID(r),
+		"method", r.Method,
+		"uri", r.URL.RequestURI(),
+	)
+}
+
+// errorResponse sends a JSON-formatted error message to the client with the
+// given status code.
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
+	env := envelope{"error": message}
+
+	err := app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// statusClientClosedRequest is recorded when the client went away before
+// the response was ready. It is non-standard (from nginx) and never reaches
+// the client, but tells those requests apart in logs and metrics.
+const statusClientClosedRequest = 499
+
+// serverErrorResponse logs the unexpected error and sends a 500 response.
+// Queries that timed out get a 503 instead, and those canceled because the
+// client disconnected are only noted, as nobody is left to read a response.
+func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, data.ErrQueryCanceled):
+		app.logger.Info(err.Error(),
+			"request_id", app.contextGetRequestID(r),
+			"method", r.Method,
+			"uri", r.URL.RequestURI(),
+		)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	case errors.Is(err, data.ErrQueryTimeout):
+		app.logError(r, err)
+
+		message := "the server took too long to process your request, please try again later"
+		app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+		return
+	}
+
+	app.logError(r, err)
+
+	message := "the server encountered a problem and could not process your request"
+	app.errorResponse(w, r, http.StatusInternalServerError, message)
+}
+
+// badRequestResponse sends the error message as is, so it must only be
+// used with errors that are safe to show to the client.
+func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+}
+
+// failedValidationResponse sends the field to message map built by a
+// validator.Validator.
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+}
+
+func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid authentication credentials"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+
+	message := "invalid or missing authentication token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must be authenticated to access this resource"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the requested resource could not be found"
+	app.errorResponse(w, r, http.StatusNotFound, message)
+}
+
+func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
+	message := "unable to update the record due to an edit conflict, please try again"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record has been modified since it was fetched, reload it and try again"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request, retryAfter int) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	message := "rate limit exceeded"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// buildInfo returns the build metadata injected at link time, falling back
+// to the VCS revision and time recorded by the Go toolchain.
+func buildInfo() map[string]string {
+	info := map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_time": buildTime,
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info["go_version"] = bi.GoVersion
+
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info["commit"] == "":
+				info["commit"] = setting.Value
+			case setting.Key == "vcs.time" && info["build_time"] == "":
+				info["build_time"] = setting.Value
+			}
+		}
+	}
+
+	return info
+}
+
+// healthcheckHandler reports that the process is up (liveness). It doesn't
+// touch the database, see readinessHandler for that.
+func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{
+		"status": "available",
+		"system_info": map[string]interface{}{
+			"environment": app.config.env,
+			"build":       buildInfo(),
+		},
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readinessHandler reports whether the API can serve traffic, i.e. whether
+// the database answers, along with the connection pool statistics.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	status, code := "ready", http.StatusOK
+	dbStatus := map[string]interface{}{"status": "up"}
+
+	err := app.db.PingContext(ctx)
+	if err != nil {
+		status, code = "not ready", http.StatusServiceUnavailable
+		dbStatus["status"] = "down"
+
+		// The error may name the database host and user, and the endpoint
+		// is public, so the details only go to the log.
+		app.logError(r, err)
+	}
+
+	stats := app.db.Stats()
+	dbStatus["pool"] = map[string]interface{}{
+		"max_open_connections": stats.MaxOpenConnections,
+		"open_connections":     stats.OpenConnections,
+		"in_use":               stats.InUse,
+		"idle":                 stats.Idle,
+		"wait_count":           stats.WaitCount,
+		"wait_duration_ms":     stats.WaitDuration.Milliseconds(),
+		"max_idle_closed":      stats.MaxIdleClosed,
+		"max_idle_time_closed": stats.MaxIdleTimeClosed,
+		"max_lifetime_closed":  stats.MaxLifetimeClosed,
+	}
+
+	env := envelope{
+		"status":   status,
+		"database": dbStatus,
+		"build":    buildInfo(),
+	}
+
+	err = app.writeJSON(w, code, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/am-silex/go_library/internal/validator"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// envelope wraps JSON responses in a top-level object, e.g. {"error": ...}.
+type envelope map[string]interface{}
+
+// writeJSON encodes data to JSON and sends it with the given status code and
+// any additional headers.
+func (app *application) writeJSON(w http.ResponseWriter, status int, data interface{}, headers http.Header) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+
+	return nil
+}
+
+// readString returns a string value from the query string, or the provided
+// default value if no matching key could be found.
+func (app *application) readString(qs url.Values, key string, defaultValue string) string {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	return s
+}
+
+// readInt reads a string value from the query string and converts it to an
+// integer. If the value can't be converted, an error message is recorded in
+// the provided Validator instance.
+func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return defaultValue
+	}
+
+	return i
+}
+
+// readIDParam reads a positive integer id from the named path wildcard.
+func (app *application) readIDParam(r *http.Request, name string) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue(name), 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid %s parameter", name)
+	}
+
+	return id, nil
+}
+
+// readJSON decodes a single JSON value from the request body into dst. The
+// errors it returns are phrased so they can be sent back to the client.
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	maxBytes := 1_048_576
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err != nil {
+		var syntaxError *json.SyntaxError
+		var unmarshalTypeError *json.UnmarshalTypeError
+		var invalidUnmarshalError *json.InvalidUnmarshalError
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &syntaxError):
+			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return errors.New("body contains badly-formed JSON")
+
+		case errors.As(err, &unmarshalTypeError):
+			if unmarshalTypeError.Field != "" {
+				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+			}
+			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+
+		case errors.Is(err, io.EOF):
+			return errors.New("body must not be empty")
+
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			return fmt.Errorf("body contains unknown key %s", fieldName)
+
+		case errors.As(err, &maxBytesError):
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+
+		// A non-pointer dst is a bug in the handler, not a client error.
+		case errors.As(err, &invalidUnmarshalError):
+			panic(err)
+
+		default:
+			return err
+		}
+	}
+
+	err = dec.Decode(&struct{}{})
+	if !errors.Is(err, io.EOF) {
+		return errors.New("body must only contain a single JSON value")
+	}
+
+	return nil
+}
+
+// readPatch reads a PATCH body into dst, a struct of pointer fields, like
+// readJSON. A JSON merge patch (RFC 7396), sent as
+// application/merge-patch+json, removes the fields set to null: their
+// names are returned so that they can be reset. Other bodies can't tell a
+// null from an omitted field, their nulls are ignored.
+func (app *application) readPatch(w http.ResponseWriter, r *http.Request, dst interface{}) (map[string]bool, error) {
+	var body json.RawMessage
+	err := app.readJSON(w, r, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	err = app.readJSON(w, r, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	nulls := make(map[string]bool)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/merge-patch+json" {
+		return nulls, nil
+	}
+
+	// dst accepted the body, so it is an object.
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(body, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range fields {
+		if string(value) == "null" {
+			nulls[name] = true
+		}
+	}
+
+	return nulls, nil
+}
+
+// patch sets *dst to *value when the field was given, or resets it to its
+// zero value when reset is true.
+func patch[T any](dst *T, value *T, reset bool) {
+	switch {
+	case value != nil:
+		*dst = *value
+	case reset:
+		var zero T
+		*dst = zero
+	}
+}
+
+// versionETag formats a record version as a strong entity tag, e.g. "3".
+func versionETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// ifMatch reports whether the request's If-Match precondition holds for a
+// record at the given version. Requests without If-Match always pass.
+func (app *application) ifMatch(r *http.Request, version int) bool {
+	values := r.Header.Values("If-Match")
+	if len(values) == 0 {
+		return true
+	}
+
+	etag := versionETag(version)
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	data "github.com/am-silex/go_library/internal/data"
 	_ "github.com/lib/pq"
-	"log"
+	"log/slog"
+	"net/netip"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -22,15 +24,58 @@ type config struct {
 	dbPass string
 	dbName string
 
-	webPort int
+	dbSSLMode          string
+	dbSSLRootCert      string
+	dbApplicationName  string
+	dbStatementTimeout time.Duration
+	dbQueryTimeout     time.Duration
+	dbMaxOpenConns     int
+	dbMaxIdleConns     int
+	dbMaxIdleTime      time.Duration
+	dbConnectTimeout   time.Duration
+
+	env      string
+	logLevel slog.Level
+
+	corsTrustedOrigins []string
+
+	limiterEnabled        bool
+	limiterRPS            float64
+	limiterBurst          int
+	limiterTrustedProxies []netip.Prefix
+
+	webHost            string
+	webPort            int
+	webReadTimeout     time.Duration
+	webWriteTimeout    time.Duration
+	webIdleTimeout     time.Duration
+	webShutdownTimeout time.Duration
+
+	// Command-line only options, see configApp.
+	showVersion bool
+	printConfig bool
+
+	// sources holds the raw value of every setting and where it came from.
+	sources map[string]rawValue
 }
 
+// Build metadata, set at build time with e.g.
+// -ldflags "-X main.version=1.2.0 -X main.commit=abc123 -X main.buildTime=2024-01-01T00:00:00Z".
+// When commit and buildTime are not set, the VCS details recorded by the Go
+// toolchain are used instead, see buildInfo.
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
 type application struct {
-	config config
-	models data.Models
-	logger *log.Logger
-	wg     sync.WaitGroup
-	db     *sql.DB
+	config  config
+	models  data.Models
+	logger  *slog.Logger
+	wg      sync.WaitGroup
+	db      *sql.DB
+	metrics *appMetrics
 }
 
 type Application interface {
@@ -56,63 +101,150 @@ func main() {
 	app = getApp()
 
 	// config & init parameters
+	args, err := configApp(app, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 	configLogger(app)
-	configApp(app)
+
+	if app.config.showVersion {
+		info := buildInfo()
+		fmt.Printf("version:\t%s\ncommit:\t\t%s\nbuild time:\t%s\n", info["version"], info["commit"], info["build_time"])
+		return
+	}
+
+	if app.config.printConfig {
+		err = app.printConfig(os.Stdout)
+		if err != nil {
+			app.logger.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 
 	db, err := openDB(app.config)
 	if err != nil {
-		app.logger.Println(err, nil)
+		app.logger.Error(err.Error())
+		os.Exit(1)
 	}
 	app.db = db
 
 	defer db.Close()
 
-	app.logger.Println("database connection pool established", nil)
+	app.logger.Info("database connection pool established")
 
-	app.models = data.NewModels(db)
+	app.metrics = newMetrics(db)
+	app.models = data.NewModels(db, app.config.dbQueryTimeout, app.metrics.observeQuery)
 
-	// Start Http server
+	// "api migrate ..." manages the schema and exits instead of serving.
+	if len(args) > 0 && args[0] == "migrate" {
+		err = app.migrate(args[1:])
+		if err != nil {
+			app.logger.Error(err.Error())
+			db.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Start Http server. Serve returns once a shutdown signal has been
+	// handled, the deferred Close then releases the connection pool.
 	err = app.Serve()
 	if err != nil {
-		app.logger.Fatalln(err)
+		app.logger.Error(err.Error())
+		db.Close()
+		os.Exit(1)
 	}
 
 }
 
-func configApp(app *application) {
-	app.config.dbHost = os.Getenv("DB_HOST")
-	app.config.dbUser = os.Getenv("DB_USER")
-	app.config.dbPass = os.Getenv("DB_PASS")
-	app.config.dbName = os.Getenv("DB_NAME")
-	app.config.dbPort, _ = strconv.Atoi(os.Getenv("DB_PORT"))
-	app.config.webPort, _ = strconv.Atoi(os.Getenv("WEB_PORT"))
-}
-
+// configLogger sets up structured JSON logging to stdout at the configured
+// level. It must run after configApp.
 func configLogger(app *application) {
-	l := log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+	l := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: app.config.logLevel}))
 	app.logger = l
 }
 
+// dsn builds the lib/pq connection string for cfg. With redact set the
+// password is masked, so the result can be logged.
+func dsn(cfg config, redact bool) string {
+	password := cfg.dbPass
+	if redact && password != "" {
+		password = "REDACTED"
+	}
+
+	params := []struct {
+		key   string
+		value string
+	}{
+		{"host", cfg.dbHost},
+		{"port", strconv.Itoa(cfg.dbPort)},
+		{"user", cfg.dbUser},
+		{"password", password},
+		{"dbname", cfg.dbName},
+		{"sslmode", cfg.dbSSLMode},
+		{"sslrootcert", cfg.dbSSLRootCert},
+		{"application_name", cfg.dbApplicationName},
+		// Unknown keys are sent by lib/pq as run-time parameters.
+		{"statement_timeout", strconv.FormatInt(cfg.dbStatementTimeout.Milliseconds(), 10)},
+	}
+
+	var parts []string
+	for _, p := range params {
+		if p.value == "" {
+			continue
+		}
+		// Values are quoted, with quotes and backslashes escaped, so that
+		// passwords containing spaces or quotes survive.
+		value := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(p.value)
+		parts = append(parts, fmt.Sprintf("%s='%s'", p.key, value))
+	}
+
+	return strings.Join(parts, " ")
+}
+
 func openDB(cfg config) (*sql.DB, error) {
 	// Use sql.Open() to create an empty connection pool, using the DSN from the
 	// config struct.
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
-		"password=%s dbname=%s sslmode=disable",
-		cfg.dbHost, cfg.dbPort, cfg.dbUser, cfg.dbPass, cfg.dbName)
-	// Debugging
-	app.logger.Println(psqlInfo)
+	app.logger.Info("connecting to database", "dsn", dsn(cfg, true))
 
-	db, err := sql.Open("postgres", psqlInfo)
+	db, err := sql.Open("postgres", dsn(cfg, false))
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	db.SetMaxOpenConns(cfg.dbMaxOpenConns)
+	db.SetMaxIdleConns(cfg.dbMaxIdleConns)
+	db.SetConnMaxIdleTime(cfg.dbMaxIdleTime)
 
-	err = db.PingContext(ctx)
-	if err != nil {
-		return nil, err
+	// Postgres may still be booting when the API starts (e.g. under
+	// compose), so keep pinging with backoff until dbConnectTimeout.
+	deadline := time.Now().Add(cfg.dbConnectTimeout)
+	backoff := 500 * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = db.PingContext(ctx)
+		cancel()
+
+		if err == nil {
+			break
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			db.Close()
+			return nil, fmt.Errorf("database unreachable after %d attempts: %w", attempt, err)
+		}
+
+		app.logger.Warn("database not ready, retrying",
+			"attempt", attempt, "backoff", backoff.String(), "error", err.Error())
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
 	}
 
 	// Return the sql.DB connection pool.
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/am-silex/go_library/internal/data"
+	"github.com/am-silex/go_library/internal/metrics"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// appMetrics holds the metrics exposed on GET /metrics.
+type appMetrics struct {
+	registry *metrics.Registry
+
+	requests         *metrics.Counter
+	requestDuration  *metrics.Histogram
+	requestsInFlight *metrics.Gauge
+
+	queryDuration *metrics.Histogram
+	queryErrors   *metrics.Counter
+}
+
+func newMetrics(db *sql.DB) *appMetrics {
+	r := metrics.NewRegistry()
+
+	m := &appMetrics{
+		registry: r,
+		requests: r.NewCounter("library_http_requests_total",
+			"HTTP requests served, by route pattern and status code.", "route", "status"),
+		requestDuration: r.NewHistogram("library_http_request_duration_seconds",
+			"Time taken to serve HTTP requests, by route pattern and status code.", metrics.DefBuckets, "route", "status"),
+		requestsInFlight: r.NewGauge("library_http_requests_in_flight",
+			"HTTP requests currently being served."),
+		queryDuration: r.NewHistogram("library_db_query_duration_seconds",
+			"Time taken by model methods, by model and method.", metrics.DefBuckets, "model", "method"),
+		queryErrors: r.NewCounter("library_db_query_errors_total",
+			"Model method calls that failed with an unexpected error, by model and method.", "model", "method"),
+	}
+
+	// The pool statistics are read from db at scrape time.
+	stat := func(fn func(s sql.DBStats) float64) func() float64 {
+		return func() float64 { return fn(db.Stats()) }
+	}
+
+	r.NewGaugeFunc("library_db_max_open_connections", "Maximum number of open connections to the database.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	r.NewGaugeFunc("library_db_open_connections", "Established connections, both in use and idle.",
+		stat(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	r.NewGaugeFunc("library_db_in_use_connections", "Connections currently in use.",
+		stat(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	r.NewGaugeFunc("library_db_idle_connections", "Idle connections.",
+		stat(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	r.NewCounterFunc("library_db_wait_count_total", "Connections waited for.",
+		stat(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	r.NewCounterFunc("library_db_wait_duration_seconds_total", "Time blocked waiting for a new connection.",
+		stat(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	r.NewCounterFunc("library_db_max_idle_closed_total", "Connections closed due to db-max-idle-conns.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }))
+	r.NewCounterFunc("library_db_max_idle_time_closed_total", "Connections closed due to db-max-idle-time.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }))
+	r.NewCounterFunc("library_db_max_lifetime_closed_total", "Connections closed due to their maximum lifetime.",
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }))
+
+	return m
+}
+
+// observeQuery is the data.QueryObserver of the models. Errors that are
+// expected outcomes, such as a missing record or an edit conflict, and
+// queries canceled by the client going away are not counted as errors.
+func (m *appMetrics) observeQuery(model, method string, duration time.Duration, err error) {
+	m.queryDuration.Observe(duration.Seconds(), model, method)
+
+	switch {
+	case err == nil,
+		errors.Is(err, data.ErrRecordNotFound),
+		errors.Is(err, data.ErrEditConflict),
+		errors.Is(err, data.ErrDuplicateISBN),
+		errors.Is(err, data.ErrAuthorHasBooks),
+		errors.Is(err, data.ErrAuthorNotFound),
+		errors.Is(err, data.ErrDuplicateBookAuthor),
+		errors.Is(err, data.ErrQueryCanceled):
+	default:
+		m.queryErrors.Inc(model, method)
+	}
+}
+
+// instrument records the request metrics. Requests are labelled with the
+// pattern of the mux route they match rather than their path, so that ids
+// don't create a series each; unmatched requests share one label.
+func (app *application) instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		app.metrics.requestsInFlight.Add(1)
+		defer app.metrics.requestsInFlight.Add(-1)
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rw, r)
+
+		status := strconv.Itoa(rw.status)
+		app.metrics.requests.Inc(route, status)
+		app.metrics.requestDuration.Observe(time.Since(start).Seconds(), route, status)
+	})
+}
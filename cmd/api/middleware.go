@@ -1,13 +1,434 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/am-silex/go_library/internal/data"
+	"github.com/am-silex/go_library/internal/validator"
+	"golang.org/x/time/rate"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// authHandler resolves the "Authorization: Bearer <token>" header into a
+// user and places it on the request context. Requests without the header
+// are passed through as data.AnonymousUser.
 func (app *application) authHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		app.logger.Println(r.Method, r.RequestURI)
-		// Auth checks goes here... Bypassing for now.
+		// The response varies on the Authorization header, so caches must
+		// not serve it to other users.
+		w.Header().Add("Vary", "Authorization")
+
+		authorizationHeader := r.Header.Get("Authorization")
+		if authorizationHeader == "" {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		token := headerParts[1]
+
+		v := validator.New()
+		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		r = app.contextSetUser(r, user)
 		h.ServeHTTP(w, r)
 	})
 }
+
+// requireAuthenticatedUser rejects requests made by data.AnonymousUser.
+func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// requirePermission rejects requests from users lacking the given
+// permission code. Anonymous users get a 401, authenticated ones a 403.
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	return app.requirePermissions([]string{code}, next)
+}
+
+// requirePermissions is requirePermission for routes needing several
+// codes, all of which must be granted. The user's permissions are loaded
+// once.
+func (app *application) requirePermissions(codes []string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		for _, code := range codes {
+			if !permissions.Include(code) {
+				app.notPermittedResponse(w, r)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireAuthenticatedUser(fn)
+}
+
+// requestIDRX restricts the X-Request-ID values accepted from clients, so
+// that they can't inject arbitrary data into the logs.
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// requestID propagates the client's X-Request-ID header, or generates a new
+// one, and places it on the request context and the response.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+
+		if !requestIDRX.MatchString(id) {
+			b := make([]byte, 16)
+			_, err := rand.Read(b)
+			if err != nil {
+				panic(err)
+			}
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		r = app.contextSetRequestID(r, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseRecorder captures the status code and size of a response for the
+// access log.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// logRequest writes one access log line per request, once it is served.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		// authHandler runs further down the chain and stores the user in
+		// a new request, so it reports it back through this holder.
+		user := &requestUser{}
+		r = app.contextSetRequestUser(r, user)
+
+		next.ServeHTTP(rw, r)
+
+		attrs := []any{
+			"request_id", app.contextGetRequestID(r),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rw.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"bytes", rw.bytes,
+			"remote_addr", r.RemoteAddr,
+		}
+		if user.user != nil && !user.user.IsAnonymous() {
+			attrs = append(attrs, "user_id", user.user.ID)
+		}
+
+		app.logger.Info("request", attrs...)
+	})
+}
+
+// recoverPanic turns a panic in a handler into a logged error, with its
+// stack trace, and a JSON 500 response instead of a dropped connection.
+func (app *application) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				// http.ErrAbortHandler is used on purpose to abort a
+				// response, net/http handles it silently.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				// The connection may be in an unknown state after a
+				// panic, so ask net/http to close it after responding.
+				w.Header().Set("Connection", "close")
+
+				app.logger.Error(fmt.Sprint(err),
+					"request_id", app.contextGetRequestID(r),
+					"method", r.Method,
+					"uri", r.URL.RequestURI(),
+					"stack", string(debug.Stack()),
+				)
+
+				message := "the server encountered a problem and could not process your request"
+				app.errorResponse(w, r, http.StatusInternalServerError, message)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimiter holds a token bucket per client, keyed by "ip:<address>" or
+// "user:<id>".
+type rateLimiter struct {
+	rps   float64
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*limitedClient
+}
+
+type limitedClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newRateLimiter returns the buckets shared by rateLimitIP and
+// rateLimitUser, or nil when rate limiting is disabled. Buckets of clients
+// not seen for a while are removed by a background task, which exits once
+// stop is closed.
+func (app *application) newRateLimiter(stop <-chan struct{}) *rateLimiter {
+	if !app.config.limiterEnabled {
+		return nil
+	}
+
+	l := &rateLimiter{
+		rps:     app.config.limiterRPS,
+		burst:   app.config.limiterBurst,
+		clients: make(map[string]*limitedClient),
+	}
+
+	app.background(func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			l.mu.Lock()
+			for key, c := range l.clients {
+				if time.Since(c.lastSeen) > 3*time.Minute {
+					delete(l.clients, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	})
+
+	return l
+}
+
+// take takes a token from the bucket of key. When none is available it
+// returns false and the number of seconds until one is.
+func (l *rateLimiter) take(key string) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c, found := l.clients[key]
+	if !found {
+		c = &limitedClient{limiter: rate.NewLimiter(rate.Limit(l.rps), l.burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = time.Now()
+
+	// A reservation, unlike Allow, tells how long until a token is
+	// available, which is what Retry-After reports.
+	now := time.Now()
+	reservation := c.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if !reservation.OK() || delay > 0 {
+		reservation.CancelAt(now)
+
+		retryAfter := int(math.Ceil(delay.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		return false, retryAfter
+	}
+
+	return true, 0
+}
+
+// rateLimitIP charges every request to the bucket of the client IP address.
+// It runs before authHandler, so that requests with invalid tokens, and
+// the token lookups they cause, are limited too.
+func (app *application) rateLimitIP(l *rateLimiter, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, retryAfter := l.take("ip:" + app.clientIP(r)); !ok {
+			app.rateLimitExceededResponse(w, r, retryAfter)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitUser additionally charges authenticated requests to the bucket
+// of their user, wherever they come from. It must run after authHandler.
+func (app *application) rateLimitUser(l *rateLimiter, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := app.contextGetUser(r); !user.IsAnonymous() {
+			if ok, retryAfter := l.take("user:" + strconv.Itoa(user.ID)); !ok {
+				app.rateLimitExceededResponse(w, r, retryAfter)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the IP address of the client. X-Forwarded-For is only
+// trusted when the request comes from one of the configured proxies; it is
+// then walked from the right, skipping trusted proxies, so that a client
+// can't pick its own address by sending the header itself.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !app.trustedProxy(host) {
+		return host
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		host = hop
+		if !app.trustedProxy(hop) {
+			break
+		}
+	}
+
+	return host
+}
+
+func (app *application) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range app.config.limiterTrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// enableCORS allows cross-origin requests from the configured trusted
+// origins and answers their preflight requests. Responses vary on the
+// Origin header, so caches must keep them apart.
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+
+		origin := r.Header.Get("Origin")
+
+		if origin != "" && validator.PermittedValue(origin, app.config.corsTrustedOrigins...) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", "Deprecation, ETag, Link, Location, Retry-After, Sunset, X-Request-ID")
+
+			// A preflight request is an OPTIONS request with the
+			// Access-Control-Request-Method header. It carries no
+			// credentials, so it is answered before authHandler.
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, PUT, PATCH, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, X-Request-ID")
+				w.Header().Set("Access-Control-Max-Age", "600")
+
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
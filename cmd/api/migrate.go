@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/am-silex/go_library/internal/migrations"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+const migrateUsage = "usage: api migrate up|down|status|goto N"
+
+// migrate runs the "migrate" subcommand against app.db.
+func (app *application) migrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	migrator, err := migrations.New(app.db)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		err = migrator.Up()
+	case "down":
+		err = migrator.Down()
+	case "goto":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil || version < 0 {
+			return fmt.Errorf("invalid migration version %q", args[1])
+		}
+		err = migrator.Goto(version)
+	case "status":
+		return app.printMigrationStatus(migrator)
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	switch {
+	case errors.Is(err, migrations.ErrNoChange):
+		app.logger.Info("migrations: no change")
+	case err != nil:
+		return err
+	default:
+		app.logger.Info("migrations: done")
+	}
+
+	return nil
+}
+
+func (app *application) printMigrationStatus(migrator *migrations.Migrator) error {
+	statuses, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range statuses {
+		appliedAt := "pending"
+		if s.AppliedAt != nil {
+			appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"github.com/am-silex/go_library/internal/data"
+	"net/http"
+	"time"
+)
+
+// The unprefixed routes predate /v1. They are deprecated since
+// legacyDeprecation and will be removed at legacySunset.
+var (
+	legacyDeprecation = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+	legacySunset      = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// route is an endpoint of a versioned API. path is relative to the version
+// prefix it is mounted under.
+type route struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+}
+
+// routes builds the mux. Each API version is a set of routes mounted under
+// its own prefix, so a /v2 with different response shapes is added by
+// writing v2Routes with its own handlers (reusing v1 ones where the shapes
+// don't change) and mounting it next to /v1.
+func (app *application) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Operational endpoints, outside of the versioned API.
+	mux.HandleFunc("GET /v1/healthcheck", app.healthcheckHandler)
+	mux.HandleFunc("GET /readyz", app.readinessHandler)
+	mux.Handle("GET /metrics", app.metrics.registry.Handler())
+
+	v1 := app.v1Routes()
+
+	mount(mux, "/v1", v1)
+
+	// Clients written before versioning keep working on the old paths,
+	// which are told to move to /v1.
+	mount(mux, "", v1, app.deprecated("/v1"))
+
+	return mux
+}
+
+func (app *application) v1Routes() []route {
+	return []route{
+		{"POST", "/books", app.requirePermission(data.PermissionBooksWrite, app.createBookHandler)},
+		{"GET", "/books", app.requirePermission(data.PermissionBooksRead, app.listBooksHandler)},
+		{"GET", "/books/{id}", app.requirePermission(data.PermissionBooksRead, app.getBookHandler)},
+		{"PUT", "/books/{id}", app.requirePermission(data.PermissionBooksWrite, app.updateBookHandler)},
+		{"PATCH", "/books/{id}", app.requirePermission(data.PermissionBooksWrite, app.partialUpdateBookHandler)},
+		{"DELETE", "/books/{id}", app.requirePermission(data.PermissionBooksWrite, app.deleteBookHandler)},
+
+		{"POST", "/authors", app.requirePermission(data.PermissionAuthorsWrite, app.createAuthorHandler)},
+		{"GET", "/authors", app.requirePermission(data.PermissionAuthorsRead, app.listAuthorsHandler)},
+		{"GET", "/authors/{id}", app.requirePermission(data.PermissionAuthorsRead, app.getAuthorHandler)},
+		{"PUT", "/authors/{id}", app.requirePermission(data.PermissionAuthorsWrite, app.updateAuthorHandler)},
+		{"PATCH", "/authors/{id}", app.requirePermission(data.PermissionAuthorsWrite, app.partialUpdateAuthorHandler)},
+		{"DELETE", "/authors/{id}", app.requirePermission(data.PermissionAuthorsWrite, app.deleteAuthorHandler)},
+
+		{"PUT", "/books/{id}/authors", app.requirePermission(data.PermissionBooksWrite, app.setBookAuthorsHandler)},
+
+		// Lists books, so reading both is required.
+		{"GET", "/authors/{id}/books",
+			app.requirePermissions([]string{data.PermissionAuthorsRead, data.PermissionBooksRead}, app.listAuthorBooksHandler)},
+
+		// Updates both entities, so both write permissions are required.
+		{"PUT", "/books/{book_id}/authors/{author_id}",
+			app.requirePermissions([]string{data.PermissionBooksWrite, data.PermissionAuthorsWrite}, app.updateBookAndAuthorHandler)},
+
+		// Creates both entities, so both write permissions are required.
+		{"POST", "/authors/with-books",
+			app.requirePermissions([]string{data.PermissionAuthorsWrite, data.PermissionBooksWrite}, app.createAuthorWithBooksHandler)},
+
+		// Returns both entities, so reading both is required.
+		{"GET", "/search",
+			app.requirePermissions([]string{data.PermissionBooksRead, data.PermissionAuthorsRead}, app.searchHandler)},
+
+		{"POST", "/users", app.registerUserHandler},
+		{"POST", "/tokens/authentication", app.createAuthenticationTokenHandler},
+	}
+}
+
+// mount registers routes under prefix, wrapping each handler in the given
+// middleware, the first one outermost.
+func mount(mux *http.ServeMux, prefix string, routes []route, middleware ...func(http.HandlerFunc) http.HandlerFunc) {
+	for _, rt := range routes {
+		handler := rt.handler
+		for i := len(middleware) - 1; i >= 0; i-- {
+			handler = middleware[i](handler)
+		}
+
+		mux.HandleFunc(rt.method+" "+prefix+rt.path, handler)
+	}
+}
+
+// deprecated marks responses of the legacy unprefixed routes with the
+// Deprecation (RFC 9745) and Sunset (RFC 8594) headers, and links to the
+// same path under successor.
+func (app *application) deprecated(successor string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", legacyDeprecation.Unix()))
+			w.Header().Set("Sunset", legacySunset.Format(http.TimeFormat))
+			w.Header().Add("Link", fmt.Sprintf(`<%s%s>; rel="successor-version"`, successor, r.URL.EscapedPath()))
+
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/am-silex/go_library/internal/validator"
+	"net/http"
+	"sort"
+)
+
+func (app *application) searchHandler(w http.ResponseWriter, r *http.Request) {
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	q := app.readString(qs, "q", "")
+	limit := app.readInt(qs, "limit", 20, v)
+
+	v.Check(q != "", "q", "must be provided")
+	v.Check(len(q) <= 500, "q", "must not be more than 500 bytes long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 100, "limit", "must be a maximum of 100")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	books, err := app.models.Books.Search(r.Context(), q, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	authors, err := app.models.Authors.Search(r.Context(), q, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Both lists are already ranked; merge them by score and keep the
+	// best limit hits overall.
+	results := append(books, authors...)
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"results": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func (app *application) Serve() error {
@@ -11,25 +17,78 @@ func (app *application) Serve() error {
 	// mux
 	// listenAndServe
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("POST /books", app.createBookHandler)
-	mux.HandleFunc("GET /books", app.listBooksHandler)
-	mux.HandleFunc("GET /books/{id}", app.getBookHandler)
-	mux.HandleFunc("PUT /books/{id}", app.updateBookHandler)
-	mux.HandleFunc("DELETE /books/{id}", app.deleteBookHandler)
+	mux := app.routes()
 
-	mux.HandleFunc("POST /authors", app.createAuthorHandler)
-	mux.HandleFunc("GET /authors", app.listAuthorsHandler)
-	mux.HandleFunc("GET /authors/{id}", app.getAuthorHandler)
-	mux.HandleFunc("PUT /authors/{id}", app.updateAuthorHandler)
-	mux.HandleFunc("DELETE /authors/{id}", app.deleteAuthorHandler)
+	// stop is closed on shutdown to end the background tasks started by the
+	// middleware, so that waiting on app.wg below terminates.
+	stop := make(chan struct{})
+	limiter := app.newRateLimiter(stop)
 
-	mux.HandleFunc("PUT /books/{book_id}/authors/{author_id}", app.updateBookAndAuthorHandler)
+	httpServer := &http.Server{
+		Addr:         fmt.Sprintf("%s:%d", app.config.webHost, app.config.webPort),
+		Handler:      app.requestID(app.instrument(mux, app.logRequest(app.recoverPanic(app.enableCORS(app.rateLimitIP(limiter, app.authHandler(app.rateLimitUser(limiter, mux)))))))),
+		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+		ReadTimeout:  app.config.webReadTimeout,
+		WriteTimeout: app.config.webWriteTimeout,
+		IdleTimeout:  app.config.webIdleTimeout,
+	}
+
+	// Shutdown makes ListenAndServe return http.ErrServerClosed at once, so
+	// the result of the shutdown itself is passed back through this channel.
+	shutdownError := make(chan error)
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		app.logger.Info("shutting down server", "signal", s.String())
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.webShutdownTimeout)
+		defer cancel()
+
+		// Background tasks are stopped and waited for even if in-flight
+		// requests outlasted the timeout; the Shutdown error is reported after.
+		err := httpServer.Shutdown(ctx)
+
+		app.logger.Info("completing background tasks", "addr", httpServer.Addr)
+
+		close(stop)
+		app.wg.Wait()
+		shutdownError <- err
+	}()
+
+	app.logger.Info("starting server", "addr", httpServer.Addr)
 
-	httpServer := &http.Server{Addr: ":8080", Handler: app.authHandler(mux)}
-	if err := httpServer.ListenAndServe(); err != nil {
-		app.logger.Fatalln(fmt.Errorf("fatal error: %w", err))
+	err := httpServer.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("fatal error: %w", err)
 	}
+
+	err = <-shutdownError
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("stopped server", "addr", httpServer.Addr)
+
 	return nil
+}
+
+// background runs fn in a goroutine tracked by app.wg, so that Serve waits
+// for it on shutdown. A panic in fn is logged instead of crashing the API.
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error("background task panic", "error", fmt.Sprint(err))
+			}
+		}()
 
+		fn()
+	}()
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"github.com/am-silex/go_library/internal/data"
+	"github.com/am-silex/go_library/internal/validator"
+	"net/http"
+)
+
+func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
+
+	var inputData struct {
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &inputData)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := &data.User{
+		Name:  inputData.Name,
+		Email: inputData.Email,
+	}
+
+	v := validator.New()
+
+	// The plaintext is checked before it is hashed: bcrypt fails on
+	// passwords over 72 bytes, which must be a 422 rather than a 500.
+	if data.ValidatePasswordPlaintext(v, inputData.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(inputData.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The user and their permissions are created together, so that a
+	// failure can't leave an account without any permission.
+	err = app.models.WithTx(r.Context(), func(tx data.Models) error {
+		err := tx.Users.Insert(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		// New accounts are patrons: they may only read the catalog. Write
+		// permissions are granted to librarians separately.
+		return tx.Permissions.AddForUser(r.Context(), user.ID, data.DefaultPermissions...)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// There is no endpoint to read a user back, hence no Location header.
+	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
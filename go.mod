@@ -2,6 +2,11 @@ module github.com/am-silex/go_library
 
 go 1.22
 
-require github.com/lib/pq v1.10.9 // indirect
+require (
+	github.com/lib/pq v1.10.9
+	golang.org/x/crypto v0.31.0
+	golang.org/x/time v0.8.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
-replace github.com/am-silex/library/internal/data => /app/internal/data/
\ No newline at end of file
+replace github.com/am-silex/library/internal/data => /app/internal/data/
@@ -4,7 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
+	"unicode/utf8"
+
+	"github.com/am-silex/go_library/internal/validator"
 )
 
 type Author struct {
@@ -13,58 +17,78 @@ type Author struct {
 	LastName    string `json:"last_name"`
 	Bio         string `json:"bio,omitempty"`
 	DateOfBirth int    `json:"date_of_birth"`
+	Version     int    `json:"version"`
+}
+
+func ValidateAuthor(v *validator.Validator, author *Author) {
+	v.Check(author.FirstName != "", "first_name", "must be provided")
+	v.Check(utf8.RuneCountInString(author.FirstName) <= 500, "first_name", "must not be more than 500 characters long")
+
+	v.Check(author.LastName != "", "last_name", "must be provided")
+	v.Check(utf8.RuneCountInString(author.LastName) <= 500, "last_name", "must not be more than 500 characters long")
+
+	v.Check(utf8.RuneCountInString(author.Bio) <= 5000, "bio", "must not be more than 5000 characters long")
+
+	// DateOfBirth holds the year of birth.
+	v.Check(author.DateOfBirth != 0, "date_of_birth", "must be provided")
+	v.Check(author.DateOfBirth <= time.Now().Year(), "date_of_birth", "must not be in the future")
 }
 
-// AuthorModel Define a struct type which wraps a sql.DB connection pool.
+// AuthorModel Define a struct type which wraps a sql.DB connection pool, or a
+// sql.Tx when obtained from Models.WithTx.
 type AuthorModel struct {
-	DB *sql.DB
+	DB      Querier
+	Observe QueryObserver
+	Timeout time.Duration
 }
 
 // Insert The method accepts a pointer to a author struct, which should contain
 // the data for the new record.
-func (m AuthorModel) Insert(author *Author, tx *sql.Tx) error {
+func (m AuthorModel) Insert(ctx context.Context, author *Author) (err error) {
+	defer m.Observe.observe("authors", "insert", time.Now(), &err)
+	defer wrapQueryError(ctx, &err)
+
 	query := `
 		INSERT INTO public.authors (first_name, last_name, bio, date_of_birth)
 		VALUES ($1, $2, $3, $4)
-		RETURNING id`
+		RETURNING id, version`
 
 	args := []interface{}{author.FirstName, author.LastName, author.Bio, author.DateOfBirth}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	switch tx {
-	case nil:
-		return m.DB.QueryRowContext(ctx, query, args...).Scan(&author.ID)
-	default:
-		return tx.QueryRowContext(ctx, query, args...).Scan(&author.ID)
-	}
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&author.ID, &author.Version)
 
 }
 
 // Get fetches a specific record from the authors table.
-func (m AuthorModel) Get(id int64) (*Author, error) {
+func (m AuthorModel) Get(ctx context.Context, id int64) (_ *Author, err error) {
+	defer m.Observe.observe("authors", "get", time.Now(), &err)
+	defer wrapQueryError(ctx, &err)
+
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
 	query := `
-		SELECT id, first_name, last_name, bio, date_of_birth
+		SELECT id, first_name, last_name, bio, date_of_birth, version
 		FROM public.authors
 		WHERE id = $1`
 
 	var author Author
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err = m.DB.QueryRowContext(ctx, query, id).Scan(
 		&author.ID,
 		&author.FirstName,
 		&author.LastName,
 		&author.Bio,
 		&author.DateOfBirth,
+		&author.Version,
 	)
 
 	if err != nil {
@@ -79,13 +103,18 @@ func (m AuthorModel) Get(id int64) (*Author, error) {
 	return &author, nil
 }
 
-// Update updates a specific record in the authors table.
-func (m AuthorModel) Update(author *Author, tx *sql.Tx) error {
+// Update updates a specific record in the authors table, provided it is
+// still at author.Version. On success author.Version is set to the new
+// version; ErrEditConflict means the row was changed or deleted meanwhile.
+func (m AuthorModel) Update(ctx context.Context, author *Author) (err error) {
+	defer m.Observe.observe("authors", "update", time.Now(), &err)
+	defer wrapQueryError(ctx, &err)
+
 	query := `
         UPDATE public.authors
-        SET first_name = $1, last_name = $2, bio = $3, date_of_birth = $4
-        WHERE id = $5
-        RETURNING id`
+        SET first_name = $1, last_name = $2, bio = $3, date_of_birth = $4, version = version + 1
+        WHERE id = $5 AND version = $6
+        RETURNING version`
 
 	args := []interface{}{
 		author.FirstName,
@@ -93,20 +122,19 @@ func (m AuthorModel) Update(author *Author, tx *sql.Tx) error {
 		author.Bio,
 		author.DateOfBirth,
 		author.ID,
+		author.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	switch tx {
-	case nil:
-		err := m.DB.QueryRowContext(ctx, query, args...).Scan(&author.ID)
-		if err != nil {
-			return err
-		}
-	default:
-		err := tx.QueryRowContext(ctx, query, args...).Scan(&author.ID)
-		if err != nil {
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&author.Version)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
 			return err
 		}
 	}
@@ -115,7 +143,10 @@ func (m AuthorModel) Update(author *Author, tx *sql.Tx) error {
 }
 
 // Delete deletes a specific record from the authors table.
-func (m AuthorModel) Delete(id int64, tx *sql.Tx) error {
+func (m AuthorModel) Delete(ctx context.Context, id int64) (err error) {
+	defer m.Observe.observe("authors", "delete", time.Now(), &err)
+	defer wrapQueryError(ctx, &err)
+
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -124,65 +155,143 @@ func (m AuthorModel) Delete(id int64, tx *sql.Tx) error {
 		DELETE FROM public.authors
 		WHERE id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	switch tx {
-	case nil:
-		result, err := m.DB.ExecContext(ctx, query, id)
-		if err != nil {
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		switch {
+		case violatedConstraint(err) == "books_authorid_fkey",
+			violatedConstraint(err) == "book_authors_author_id_fkey":
+			return ErrAuthorHasBooks
+		default:
 			return err
 		}
+	}
 
-		rowsAffected, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
 
-		if rowsAffected == 0 {
-			return ErrRecordNotFound
-		}
-	default:
-		result, err := tx.ExecContext(ctx, query, id)
-		if err != nil {
-			return err
-		}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// AuthorSortColumns maps the sort keys accepted by GetAll to author columns.
+var AuthorSortColumns = map[string]string{
+	"id":            "id",
+	"first_name":    "first_name",
+	"last_name":     "last_name",
+	"date_of_birth": "date_of_birth",
+}
+
+// GetAll method returns a page of authors matching the filters, together
+// with the pagination metadata. name matches the beginning of either the
+// first or the last name; a zero value disables a filter.
+func (m AuthorModel) GetAll(ctx context.Context, name string, bornFrom int, bornTo int, filters Filters) (_ []*Author, _ Metadata, err error) {
+	defer m.Observe.observe("authors", "get_all", time.Now(), &err)
+	defer wrapQueryError(ctx, &err)
+
+	where := `
+		WHERE (first_name ILIKE $1 || '%' ESCAPE '\' OR last_name ILIKE $1 || '%' ESCAPE '\' OR $1 = '')
+		AND (date_of_birth >= $2 OR $2 = 0)
+		AND (date_of_birth <= $3 OR $3 = 0)`
+
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, first_name, last_name, bio, date_of_birth, version
+		FROM public.authors%s
+		ORDER BY %s %s, id ASC
+		LIMIT $4 OFFSET $5`, where, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{escapeLike(name), bornFrom, bornTo, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
 
-		rowsAffected, err := result.RowsAffected()
+	defer rows.Close()
+
+	totalRecords := 0
+	authors := []*Author{}
+
+	for rows.Next() {
+		var author Author
+
+		err := rows.Scan(
+			&totalRecords,
+			&author.ID,
+			&author.FirstName,
+			&author.LastName,
+			&author.Bio,
+			&author.DateOfBirth,
+			&author.Version,
+		)
 		if err != nil {
-			return err
+			return nil, Metadata{}, err
 		}
 
-		if rowsAffected == 0 {
-			return ErrRecordNotFound
-		}
+		authors = append(authors, &author)
+	}
 
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
 	}
 
-	return nil
+	// Past the last page there is no row to carry the count, so it is
+	// queried on its own.
+	if len(authors) == 0 && filters.Page > 1 {
+		err = m.DB.QueryRowContext(ctx, `SELECT count(*) FROM public.authors`+where, args[:3]...).Scan(&totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return authors, metadata, nil
 }
 
-// GetAll method returns a slice of authors.
-func (m AuthorModel) GetAll() ([]*Author, error) {
-	query := `
-		SELECT id, first_name, last_name, bio, date_of_birth
-		FROM public.authors
-		ORDER BY last_name ASC`
+// Search returns up to limit authors whose name or bio match the
+// websearch-style query q, ordered by relevance.
+func (m AuthorModel) Search(ctx context.Context, q string, limit int) (_ []*SearchResult, err error) {
+	defer m.Observe.observe("authors", "search", time.Now(), &err)
+	defer wrapQueryError(ctx, &err)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	query := `
+		SELECT a.id, a.first_name, a.last_name, a.bio, a.date_of_birth, a.version,
+			ts_rank(a.search, q) AS score,
+			ts_headline('simple',
+				` + escapeHTML(`a.first_name || ' ' || a.last_name || coalesce(': ' || a.bio, '')`) + `,
+				q, 'StartSel=<b>, StopSel=</b>') AS snippet
+		FROM public.authors a,
+			websearch_to_tsquery('simple', $1) q
+		WHERE a.search @@ q
+		ORDER BY score DESC, a.id ASC
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.DB.QueryContext(ctx, query, q, limit)
 	if err != nil {
 		return nil, err
 	}
 
 	defer rows.Close()
 
-	authors := []*Author{}
+	results := []*SearchResult{}
 
 	for rows.Next() {
 		var author Author
+		result := SearchResult{Type: SearchTypeAuthor, Author: &author}
 
 		err := rows.Scan(
 			&author.ID,
@@ -190,17 +299,20 @@ func (m AuthorModel) GetAll() ([]*Author, error) {
 			&author.LastName,
 			&author.Bio,
 			&author.DateOfBirth,
+			&author.Version,
+			&result.Score,
+			&result.Snippet,
 		)
 		if err != nil {
 			return nil, err
 		}
 
-		authors = append(authors, &author)
+		results = append(results, &result)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return authors, nil
+	return results, nil
 }
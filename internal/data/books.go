@@ -3,69 +3,261 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
+
+	"github.com/am-silex/go_library/internal/validator"
+	"github.com/lib/pq"
 )
 
+// Book is a book of the catalog. Authors lists everyone credited on it, in
+// order; AuthorID is its primary author and predates Authors, it is kept
+// for older clients. Authors is read-only, see BookModel.SetAuthors.
 type Book struct {
-	ID       int    `json:"id"`
-	Title    string `json:"title"`
-	AuthorID int    `json:"author_id"`
-	Year     int    `json:"year,omitempty"`
-	ISBN     string `json:"isbn"`
+	ID       int          `json:"id"`
+	Title    string       `json:"title"`
+	AuthorID int          `json:"author_id"`
+	Authors  []BookAuthor `json:"authors"`
+	Year     int          `json:"year,omitempty"`
+	ISBN     string       `json:"isbn"`
+	Version  int          `json:"version"`
+
+	// Author is the primary author, only loaded on request, see
+	// BookInclude.
+	Author *Author `json:"author,omitempty"`
+}
+
+// BookInclude selects the related records embedded in the books returned
+// by BookModel.Get and GetAll. They are joined in the same query.
+type BookInclude struct {
+	Author bool
+}
+
+// BookIncludes are the names accepted by ParseBookInclude.
+var BookIncludes = []string{"author"}
+
+// ParseBookInclude reads a comma-separated list of BookIncludes, as given
+// in the include query string parameter.
+func ParseBookInclude(v *validator.Validator, s string) BookInclude {
+	var include BookInclude
+
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+
+		switch name {
+		case "":
+		case "author":
+			include.Author = true
+		default:
+			v.AddError("include", "must be a comma-separated list of "+strings.Join(BookIncludes, ", "))
+		}
+	}
+
+	return include
+}
+
+// BookAuthor is an author credited on a book, in one of BookAuthorRoles.
+type BookAuthor struct {
+	ID   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+	Role string `json:"role"`
+}
+
+// RoleAuthor is the role of the people who wrote a book; the first of them
+// is the book's primary author.
+const RoleAuthor = "author"
+
+// BookAuthorRoles are the roles an author can have on a book. They must
+// match the book_authors_role_check constraint.
+var BookAuthorRoles = []string{RoleAuthor, "editor", "translator", "illustrator"}
+
+func ValidateBook(v *validator.Validator, book *Book) {
+	v.Check(book.Title != "", "title", "must be provided")
+	v.Check(utf8.RuneCountInString(book.Title) <= 500, "title", "must not be more than 500 characters long")
+
+	v.Check(book.AuthorID > 0, "author_id", "must be provided")
+
+	// Year is optional, zero means unknown.
+	v.Check(book.Year >= 0, "year", "must not be negative")
+	v.Check(book.Year <= time.Now().Year(), "year", "must not be in the future")
+
+	v.Check(book.ISBN != "", "isbn", "must be provided")
+	v.Check(validator.ValidISBN(book.ISBN), "isbn", "must be a valid ISBN-10 or ISBN-13")
 }
 
-// BookModel Define a struct type which wraps a sql.DB connection pool.
+// ValidateBookAuthors checks a list of authors for BookModel.SetAuthors.
+// Errors on entries are keyed by their index, e.g. "authors[1].role".
+func ValidateBookAuthors(v *validator.Validator, authors []BookAuthor) {
+	v.Check(len(authors) > 0, "authors", "must be provided")
+	v.Check(len(authors) <= 20, "authors", "must not contain more than 20 entries")
+
+	hasAuthor := false
+	seen := make(map[BookAuthor]bool)
+
+	for i, author := range authors {
+		key := fmt.Sprintf("authors[%d]", i)
+
+		v.Check(author.ID > 0, key+".id", "must be provided")
+		v.Check(validator.PermittedValue(author.Role, BookAuthorRoles...), key+".role",
+			"must be one of "+strings.Join(BookAuthorRoles, ", "))
+
+		entry := BookAuthor{ID: author.ID, Role: author.Role}
+		v.Check(!seen[entry], key, "duplicates an earlier entry")
+		seen[entry] = true
+
+		hasAuthor = hasAuthor || author.Role == RoleAuthor
+	}
+
+	v.Check(hasAuthor, "authors", "must include someone with the author role")
+}
+
+// authorsColumn selects the authors of the book aliased b as a JSON array,
+// so that they are loaded by the same query as the book itself.
+const authorsColumn = `
+	coalesce((
+		SELECT json_agg(json_build_object(
+			'id', a.id, 'name', a.first_name || ' ' || a.last_name, 'role', ba.role)
+			ORDER BY ba.position, a.id)
+		FROM public.book_authors ba
+		JOIN public.authors a ON a.id = ba.author_id
+		WHERE ba.book_id = b.id
+	), '[]')`
+
+// authorJoin joins the primary author of the book aliased b as pa, whose
+// authorColumns are scanned by scanAuthor.
+const (
+	authorJoin    = `JOIN public.authors pa ON pa.id = b.authorid`
+	authorColumns = `pa.id, pa.first_name, pa.last_name, pa.bio, pa.date_of_birth, pa.version`
+)
+
+// includeSQL returns the columns, with a leading comma, and the joins that
+// load the records selected by include.
+func includeSQL(include BookInclude) (columns, joins string) {
+	if include.Author {
+		columns += ", " + authorColumns
+		joins += " " + authorJoin
+	}
+	return columns, joins
+}
+
+// includeDest returns the scan destinations of the columns of includeSQL,
+// allocating the included records of book.
+func includeDest(book *Book, include BookInclude) []interface{} {
+	var dest []interface{}
+
+	if include.Author {
+		book.Author = &Author{}
+		dest = append(dest,
+			&book.Author.ID,
+			&book.Author.FirstName,
+			&book.Author.LastName,
+			&book.Author.Bio,
+			&book.Author.DateOfBirth,
+			&book.Author.Version,
+		)
+	}
+
+	return dest
+}
+
+// BookModel Define a struct type which wraps a sql.DB connection pool, or a
+// sql.Tx when obtained from Models.WithTx.
 type BookModel struct {
-	DB *sql.DB
+	DB      Querier
+	Observe QueryObserver
+	Timeout time.Duration
 }
 
 // Insert The method accepts a pointer to a book struct, which should contain
-// the data for the new record.
-func (m BookModel) Insert(book *Book, tx *sql.Tx) error {
+// the data for the new record. ErrAuthorNotFound means book.AuthorID doesn't reference an
+// existing author.
+func (m BookModel) Insert(ctx context.Context, book *Book) (err error) {
+	defer m.Observe.observe("books", "insert", time.Now(), &err)
+	defer wrapQueryError(ctx, &err)
+
+	// The primary author is also listed in book_authors, in the same
+	// statement so that a book is never left without it.
 	query := `
-		INSERT INTO public.books (title, authorid, year, isbn)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id`
+		WITH book AS (
+			INSERT INTO public.books (title, authorid, year, isbn)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, authorid, version
+		), credit AS (
+			INSERT INTO public.book_authors (book_id, author_id, role, position)
+			SELECT id, authorid, 'author', 1 FROM book
+		)
+		SELECT book.id, book.version, json_build_array(json_build_object(
+			'id', a.id, 'name', a.first_name || ' ' || a.last_name, 'role', 'author'))
+		FROM book
+		JOIN public.authors a ON a.id = book.authorid`
+
+	// ISBNs are stored normalized, so that books_isbn_key catches the same
+	// ISBN written with or without hyphens.
+	book.ISBN = validator.NormalizeISBN(book.ISBN)
 
 	args := []interface{}{book.Title, book.AuthorID, book.Year, book.ISBN}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	switch tx {
-	case nil:
-		return m.DB.QueryRowContext(ctx, query, args...).Scan(&book.ID)
-	default:
-		return tx.QueryRowContext(ctx, query, args...).Scan(&book.ID)
+	var authors []byte
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&book.ID, &book.Version, &authors)
+
+	if err != nil {
+		switch {
+		case violatedConstraint(err) == "books_isbn_key":
+			return ErrDuplicateISBN
+		case violatedConstraint(err) == "books_authorid_fkey",
+			violatedConstraint(err) == "book_authors_author_id_fkey":
+			return ErrAuthorNotFound
+		default:
+			return err
+		}
 	}
 
+	return json.Unmarshal(authors, &book.Authors)
 }
 
-// Get fetches a specific record from the books table.
-func (m BookModel) Get(id int64) (*Book, error) {
+// Get fetches a specific record from the books table, with the related
+// records selected by include.
+func (m BookModel) Get(ctx context.Context, id int64, include BookInclude) (_ *Book, err error) {
+	defer m.Observe.observe("books", "get", time.Now(), &err)
+	defer wrapQueryError(ctx, &err)
+
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
+	columns, joins := includeSQL(include)
+
 	query := `
-		SELECT id, title, authorid, year, isbn
-		FROM public.books
-		WHERE id = $1`
+		SELECT b.id, b.title, b.authorid, ` + authorsColumn + `, b.year, b.isbn, b.version` + columns + `
+		FROM public.books b` + joins + `
+		WHERE b.id = $1`
 
 	var book Book
+	var authors []byte
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	dest := []interface{}{
 		&book.ID,
 		&book.Title,
 		&book.AuthorID,
+		&authors,
 		&book.Year,
 		&book.ISBN,
-	)
+		&book.Version,
+	}
+
+	err = m.DB.QueryRowContext(ctx, query, id).Scan(append(dest, includeDest(&book, include)...)...)
 
 	if err != nil {
 		switch {
@@ -76,16 +268,48 @@ func (m BookModel) Get(id int64) (*Book, error) {
 		}
 	}
 
+	err = json.Unmarshal(authors, &book.Authors)
+	if err != nil {
+		return nil, err
+	}
+
 	return &book, nil
 }
 
-// Update updates a specific record in the books table.
-func (m BookModel) Update(book *Book, tx *sql.Tx) error {
+// Update updates a specific record in the books table, provided it is still
+// at book.Version. On success book.Version is set to the new version;
+// ErrEditConflict means the row was changed or deleted in the meantime.
+//
+// A new AuthorID takes over the entry of the previous primary author in
+// the book's authors, the others are kept. ErrDuplicateBookAuthor means
+// the new primary author was already listed as an author, ErrAuthorNotFound
+// that it doesn't exist.
+func (m BookModel) Update(ctx context.Context, book *Book) (err error) {
+	defer m.Observe.observe("books", "update", time.Now(), &err)
+	defer wrapQueryError(ctx, &err)
+
 	query := `
-        UPDATE public.books
-        SET title = $1, year = $2, authorid = $3, isbn = $4
-        WHERE id = $5
-        RETURNING id`
+        WITH previous AS (
+            SELECT id, authorid
+            FROM public.books
+            WHERE id = $5 AND version = $6
+            FOR UPDATE
+        ), book AS (
+            UPDATE public.books b
+            SET title = $1, year = $2, authorid = $3, isbn = $4, version = b.version + 1
+            FROM previous
+            WHERE b.id = previous.id
+            RETURNING b.id, b.version, previous.authorid AS previous_authorid
+        ), credit AS (
+            UPDATE public.book_authors ba
+            SET author_id = $3
+            FROM book
+            WHERE ba.book_id = book.id AND ba.author_id = book.previous_authorid
+            AND ba.role = 'author' AND book.previous_authorid <> $3
+        )
+        SELECT version FROM book`
+
+	book.ISBN = validator.NormalizeISBN(book.ISBN)
 
 	args := []interface{}{
 		book.Title,
@@ -93,29 +317,123 @@ func (m BookModel) Update(book *Book, tx *sql.Tx) error {
 		book.AuthorID,
 		book.ISBN,
 		book.ID,
+		book.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	switch tx {
-	case nil:
-		err := m.DB.QueryRowContext(ctx, query, args...).Scan(&book.ID)
-		if err != nil {
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&book.Version)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case violatedConstraint(err) == "books_isbn_key":
+			return ErrDuplicateISBN
+		case violatedConstraint(err) == "books_authorid_fkey",
+			violatedConstraint(err) == "book_authors_author_id_fkey":
+			return ErrAuthorNotFound
+		case violatedConstraint(err) == "book_authors_pkey":
+			return ErrDuplicateBookAuthor
+		default:
 			return err
 		}
-	default:
-		err := tx.QueryRowContext(ctx, query, args...).Scan(&book.ID)
-		if err != nil {
+	}
+
+	book.Authors, err = m.authors(ctx, book.ID)
+	return err
+}
+
+// SetAuthors replaces the authors of a book, provided it is still at
+// book.Version, and makes the first one with RoleAuthor its primary
+// author. On success book.Version, book.AuthorID and book.Authors are
+// updated. ErrAuthorNotFound means one of the authors doesn't exist.
+func (m BookModel) SetAuthors(ctx context.Context, book *Book, authors []BookAuthor) (err error) {
+	defer m.Observe.observe("books", "set_authors", time.Now(), &err)
+	defer wrapQueryError(ctx, &err)
+
+	primary := 0
+	ids := make([]int64, len(authors))
+	roles := make([]string, len(authors))
+	for i, author := range authors {
+		ids[i] = int64(author.ID)
+		roles[i] = author.Role
+		if primary == 0 && author.Role == RoleAuthor {
+			primary = author.ID
+		}
+	}
+
+	// A single statement, so that the book and its authors change together
+	// without a transaction. The links are only touched when the version
+	// matched; entries that are kept are renumbered in place, the others
+	// removed, so the statement never deletes and inserts the same link.
+	query := `
+		WITH book AS (
+			UPDATE public.books
+			SET authorid = $1, version = version + 1
+			WHERE id = $2 AND version = $3
+			RETURNING id, version
+		), entries AS (
+			SELECT e.author_id, e.role, e.position
+			FROM unnest($4::integer[], $5::varchar[]) WITH ORDINALITY AS e(author_id, role, position)
+		), removed AS (
+			DELETE FROM public.book_authors ba
+			USING book
+			WHERE ba.book_id = book.id
+			AND (ba.author_id, ba.role) NOT IN (SELECT author_id, role FROM entries)
+		), credited AS (
+			INSERT INTO public.book_authors (book_id, author_id, role, position)
+			SELECT book.id, e.author_id, e.role, e.position
+			FROM book, entries e
+			ON CONFLICT (book_id, author_id, role) DO UPDATE SET position = excluded.position
+		)
+		SELECT version FROM book`
+
+	args := []interface{}{primary, book.ID, book.Version, pq.Array(ids), pq.Array(roles)}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&book.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case violatedConstraint(err) == "books_authorid_fkey",
+			violatedConstraint(err) == "book_authors_author_id_fkey":
+			return ErrAuthorNotFound
+		default:
 			return err
 		}
 	}
 
-	return nil
+	book.AuthorID = primary
+	book.Authors, err = m.authors(ctx, book.ID)
+	return err
+}
+
+// authors loads the authors of a single book.
+func (m BookModel) authors(ctx context.Context, bookID int) ([]BookAuthor, error) {
+	query := `SELECT ` + authorsColumn + ` FROM public.books b WHERE b.id = $1`
+
+	var authors []byte
+
+	err := m.DB.QueryRowContext(ctx, query, bookID).Scan(&authors)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []BookAuthor
+	err = json.Unmarshal(authors, &result)
+	return result, err
 }
 
 // Delete deletes a specific record from the books table.
-func (m BookModel) Delete(id int64, tx *sql.Tx) error {
+func (m BookModel) Delete(ctx context.Context, id int64) (err error) {
+	defer m.Observe.observe("books", "delete", time.Now(), &err)
+	defer wrapQueryError(ctx, &err)
+
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -124,80 +442,186 @@ func (m BookModel) Delete(id int64, tx *sql.Tx) error {
 		DELETE FROM public.books
 		WHERE id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	switch tx {
-	case nil:
-		result, err := m.DB.ExecContext(ctx, query, id)
-		if err != nil {
-			return err
-		}
-		rowsAffected, err := result.RowsAffected()
-		if err != nil {
-			return err
-		}
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
 
-		if rowsAffected == 0 {
-			return ErrRecordNotFound
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// BookSortColumns maps the sort keys accepted by GetAll to book columns.
+var BookSortColumns = map[string]string{
+	"id":        "id",
+	"title":     "title",
+	"author_id": "authorid",
+	"year":      "year",
+}
+
+// GetAll method returns a page of books matching the filters, together with
+// the pagination metadata. authorID matches books the author is credited
+// on in any role. A zero value for title, authorID, yearFrom or yearTo
+// disables that filter. The related records selected by include are
+// loaded by the same query.
+func (m BookModel) GetAll(ctx context.Context, title string, authorID int, yearFrom int, yearTo int, filters Filters, include BookInclude) (_ []*Book, _ Metadata, err error) {
+	defer m.Observe.observe("books", "get_all", time.Now(), &err)
+	defer wrapQueryError(ctx, &err)
+
+	where := `
+		WHERE (b.title ILIKE '%' || $1 || '%' ESCAPE '\' OR $1 = '')
+		AND ($2 = 0 OR EXISTS (
+			SELECT 1 FROM public.book_authors ba WHERE ba.book_id = b.id AND ba.author_id = $2))
+		AND (b.year >= $3 OR $3 = 0)
+		AND (b.year <= $4 OR $4 = 0)`
+
+	// The total count is computed by a window function in the same query, so
+	// it always agrees with the page that was returned. The sort column comes
+	// from a safelist and id is appended to keep the order deterministic.
+	columns, joins := includeSQL(include)
+
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), b.id, b.title, b.authorid, %s, b.year, b.isbn, b.version%s
+		FROM public.books b%s%s
+		ORDER BY b.%s %s, b.id ASC
+		LIMIT $5 OFFSET $6`, authorsColumn, columns, joins, where, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{escapeLike(title), authorID, yearFrom, yearTo, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	books := []*Book{}
+
+	for rows.Next() {
+		var book Book
+		var authors []byte
+
+		dest := []interface{}{
+			&totalRecords,
+			&book.ID,
+			&book.Title,
+			&book.AuthorID,
+			&authors,
+			&book.Year,
+			&book.ISBN,
+			&book.Version,
 		}
-	default:
-		result, err := tx.ExecContext(ctx, query, id)
+
+		err := rows.Scan(append(dest, includeDest(&book, include)...)...)
 		if err != nil {
-			return err
+			return nil, Metadata{}, err
 		}
-		rowsAffected, err := result.RowsAffected()
+
+		err = json.Unmarshal(authors, &book.Authors)
 		if err != nil {
-			return err
+			return nil, Metadata{}, err
 		}
 
-		if rowsAffected == 0 {
-			return ErrRecordNotFound
+		books = append(books, &book)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	// Past the last page there is no row to carry the count, so it is
+	// queried on its own.
+	if len(books) == 0 && filters.Page > 1 {
+		err = m.DB.QueryRowContext(ctx, `SELECT count(*) FROM public.books b`+where, args[:4]...).Scan(&totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
 		}
 	}
 
-	return nil
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return books, metadata, nil
 }
 
-// GetAll method returns a slice of books.
-func (m BookModel) GetAll() ([]*Book, error) {
-	query := `
-		SELECT id, title, authorid, year, isbn
-		FROM public.books
-		ORDER BY title ASC`
+// Search returns up to limit books whose title or author's name or bio
+// match the websearch-style query q, ordered by relevance.
+func (m BookModel) Search(ctx context.Context, q string, limit int) (_ []*SearchResult, err error) {
+	defer m.Observe.observe("books", "search", time.Now(), &err)
+	defer wrapQueryError(ctx, &err)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// The author's search vector is concatenated to the book's one, so a
+	// book ranks higher when the query hits both its title and its author.
+	query := `
+		SELECT b.id, b.title, b.authorid, ` + authorsColumn + `, b.year, b.isbn, b.version,
+			ts_rank(b.search || coalesce(a.search, ''::tsvector), q) AS score,
+			ts_headline('simple',
+				` + escapeHTML(`b.title || coalesce(' — ' || a.first_name || ' ' || a.last_name, '')`) + `,
+				q, 'StartSel=<b>, StopSel=</b>') AS snippet
+		FROM public.books b
+		LEFT JOIN public.authors a ON a.id = b.authorid,
+			websearch_to_tsquery('simple', $1) q
+		WHERE b.search @@ q OR a.search @@ q
+		ORDER BY score DESC, b.id ASC
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.DB.QueryContext(ctx, query, q, limit)
 	if err != nil {
 		return nil, err
 	}
 
 	defer rows.Close()
 
-	books := []*Book{}
+	results := []*SearchResult{}
 
 	for rows.Next() {
 		var book Book
+		var authors []byte
+		result := SearchResult{Type: SearchTypeBook, Book: &book}
 
 		err := rows.Scan(
 			&book.ID,
 			&book.Title,
 			&book.AuthorID,
+			&authors,
 			&book.Year,
 			&book.ISBN,
+			&book.Version,
+			&result.Score,
+			&result.Snippet,
 		)
 		if err != nil {
 			return nil, err
 		}
 
-		books = append(books, &book)
+		err = json.Unmarshal(authors, &book.Authors)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, &result)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return books, nil
+	return results, nil
 }
@@ -0,0 +1,85 @@
+package data
+
+import (
+	"math"
+	"strings"
+
+	"github.com/am-silex/go_library/internal/validator"
+)
+
+// Filters holds the sorting and pagination parameters shared by the list
+// endpoints. SortColumns maps the sort keys accepted from clients to the
+// SQL columns they order by; a leading "-" on Sort means descending.
+type Filters struct {
+	Page        int
+	PageSize    int
+	Sort        string
+	SortColumns map[string]string
+}
+
+func ValidateFilters(v *validator.Validator, f Filters) {
+	v.Check(f.Page > 0, "page", "must be greater than zero")
+	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
+	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
+	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+
+	_, ok := f.SortColumns[strings.TrimPrefix(f.Sort, "-")]
+	v.Check(ok, "sort", "invalid sort value")
+}
+
+// sortColumn returns the SQL column for the Sort key. Sort values are
+// interpolated into queries, so anything outside SortColumns is a bug
+// that must never reach the database.
+func (f Filters) sortColumn() string {
+	column, ok := f.SortColumns[strings.TrimPrefix(f.Sort, "-")]
+	if !ok {
+		panic("unsafe sort parameter: " + f.Sort)
+	}
+	return column
+}
+
+func (f Filters) sortDirection() string {
+	if strings.HasPrefix(f.Sort, "-") {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+func (f Filters) limit() int {
+	return f.PageSize
+}
+
+func (f Filters) offset() int {
+	return (f.Page - 1) * f.PageSize
+}
+
+// escapeLike escapes the LIKE wildcards in s, so that user input matches
+// literally in a pattern with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Metadata holds the pagination details returned alongside a list.
+type Metadata struct {
+	CurrentPage  int `json:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty"`
+	TotalRecords int `json:"total_records"`
+}
+
+// calculateMetadata builds the Metadata for a page, given the total number
+// of records matching the filters. An empty result yields empty Metadata.
+func calculateMetadata(totalRecords, page, pageSize int) Metadata {
+	if totalRecords == 0 {
+		return Metadata{}
+	}
+
+	return Metadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		TotalRecords: totalRecords,
+	}
+}
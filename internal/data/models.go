@@ -1,41 +1,155 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 // ErrRecordNotFound Define a custom ErrRecordNotFound error.
 var (
 	ErrRecordNotFound = errors.New("record not found")
+	ErrEditConflict   = errors.New("edit conflict")
+	ErrDuplicateISBN  = errors.New("duplicate isbn")
+	ErrAuthorHasBooks = errors.New("author has books")
+
+	// ErrAuthorNotFound means an author referenced by a book doesn't
+	// exist, ErrDuplicateBookAuthor that the author is already credited
+	// on the book in that role.
+	ErrAuthorNotFound      = errors.New("author not found")
+	ErrDuplicateBookAuthor = errors.New("duplicate book author")
+
+	// ErrQueryTimeout means a query ran out of time, either the model's
+	// timeout, a deadline on the caller's context or the server's
+	// statement_timeout. ErrQueryCanceled means the caller's context was
+	// canceled, typically because the client went away.
+	ErrQueryTimeout  = errors.New("query timed out")
+	ErrQueryCanceled = errors.New("query canceled")
 )
 
+// DefaultQueryTimeout bounds every query when NewModels is given no timeout.
+const DefaultQueryTimeout = 3 * time.Second
+
+// Models groups the models. Those returned by NewModels run their queries
+// on the connection pool; WithTx hands out copies running inside a
+// transaction.
 type Models struct {
 	Books interface {
-		Insert(book *Book, tx *sql.Tx) error
-		Get(id int64) (*Book, error)
-		Update(book *Book, tx *sql.Tx) error
-		Delete(id int64, tx *sql.Tx) error
-		GetAll() ([]*Book, error)
+		Insert(ctx context.Context, book *Book) error
+		Get(ctx context.Context, id int64, include BookInclude) (*Book, error)
+		Update(ctx context.Context, book *Book) error
+		Delete(ctx context.Context, id int64) error
+		SetAuthors(ctx context.Context, book *Book, authors []BookAuthor) error
+		GetAll(ctx context.Context, title string, authorID int, yearFrom int, yearTo int, filters Filters, include BookInclude) ([]*Book, Metadata, error)
+		Search(ctx context.Context, q string, limit int) ([]*SearchResult, error)
 	}
 	Authors interface {
-		Insert(book *Author, tx *sql.Tx) error
-		Get(id int64) (*Author, error)
-		Update(book *Author, tx *sql.Tx) error
-		Delete(id int64, tx *sql.Tx) error
-		GetAll() ([]*Author, error)
+		Insert(ctx context.Context, book *Author) error
+		Get(ctx context.Context, id int64) (*Author, error)
+		Update(ctx context.Context, book *Author) error
+		Delete(ctx context.Context, id int64) error
+		GetAll(ctx context.Context, name string, bornFrom int, bornTo int, filters Filters) ([]*Author, Metadata, error)
+		Search(ctx context.Context, q string, limit int) ([]*SearchResult, error)
+	}
+	Users interface {
+		Insert(ctx context.Context, user *User) error
+		GetByEmail(ctx context.Context, email string) (*User, error)
+		GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+	}
+	Tokens interface {
+		New(ctx context.Context, userID int, ttl time.Duration, scope string) (*Token, error)
+		Insert(ctx context.Context, token *Token) error
+		DeleteAllForUser(ctx context.Context, scope string, userID int) error
+	}
+	Permissions interface {
+		GetAllForUser(ctx context.Context, userID int) (Permissions, error)
+		AddForUser(ctx context.Context, userID int, codes ...string) error
 	}
-	Translations interface {
-		Create() (*sql.Tx, error)
-		Commit(*sql.Tx) error
-		Rollback(*sql.Tx) error
+
+	db      *sql.DB
+	tx      *sql.Tx
+	timeout time.Duration
+	observe QueryObserver
+}
+
+// Querier is the part of *sql.DB and *sql.Tx the models use, so that the
+// same model code runs with or without a transaction.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// QueryObserver is told the duration and outcome of every BookModel and
+// AuthorModel method call, model is "books" or "authors" and method the
+// snake_case method name, e.g. "get_all".
+type QueryObserver func(model, method string, duration time.Duration, err error)
+
+// observe reports a call to o, if set. It is deferred at the top of a model
+// method with the start time and a pointer to the method's error result.
+func (o QueryObserver) observe(model, method string, start time.Time, err *error) {
+	if o != nil {
+		o(model, method, time.Since(start), *err)
+	}
+}
+
+// NewModels returns the models backed by db. Every query is bounded by
+// timeout, on top of the deadline of the context it is given; zero means
+// DefaultQueryTimeout. observe may be nil.
+func NewModels(db *sql.DB, timeout time.Duration, observe QueryObserver) Models {
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+
+	m := Models{db: db, timeout: timeout, observe: observe}
+	return m.using(db)
+}
+
+// using returns a copy of m whose models run their queries on q.
+func (m Models) using(q Querier) Models {
+	m.Books = BookModel{DB: q, Timeout: m.timeout, Observe: m.observe}
+	m.Authors = AuthorModel{DB: q, Timeout: m.timeout, Observe: m.observe}
+	m.Users = UserModel{DB: q, Timeout: m.timeout}
+	m.Tokens = TokenModel{DB: q, Timeout: m.timeout}
+	m.Permissions = PermissionModel{DB: q, Timeout: m.timeout}
+	return m
+}
+
+// wrapQueryError turns *err into ErrQueryCanceled or ErrQueryTimeout when
+// the query didn't complete for lack of time, wrapping the original error.
+// ctx is the context the model method was called with, it is deferred at
+// the top of the method with a pointer to its error result.
+func wrapQueryError(ctx context.Context, err *error) {
+	if *err == nil {
+		return
+	}
+
+	var pqErr *pq.Error
+
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		*err = fmt.Errorf("%w: %w", ErrQueryCanceled, *err)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded),
+		errors.Is(*err, context.DeadlineExceeded):
+		*err = fmt.Errorf("%w: %w", ErrQueryTimeout, *err)
+	case errors.As(*err, &pqErr) && pqErr.Code == "57014":
+		// query_canceled while the caller's context is still live: the
+		// model's own timeout made lib/pq cancel the query, or the server
+		// hit statement_timeout.
+		*err = fmt.Errorf("%w: %w", ErrQueryTimeout, *err)
 	}
 }
 
-func NewModels(db *sql.DB) Models {
-	return Models{
-		Books:        BookModel{DB: db},
-		Authors:      AuthorModel{DB: db},
-		Translations: Transactions{DB: db},
+// violatedConstraint returns the name of the constraint err violated, or ""
+// if err isn't a constraint violation reported by PostgreSQL.
+func violatedConstraint(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Class() == "23" {
+		return pqErr.Constraint
 	}
+	return ""
 }
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Permission codes checked by the API. They must match the rows seeded into
+// the permissions table.
+const (
+	PermissionBooksRead    = "books:read"
+	PermissionBooksWrite   = "books:write"
+	PermissionAuthorsRead  = "authors:read"
+	PermissionAuthorsWrite = "authors:write"
+)
+
+// DefaultPermissions are granted to every newly registered user (patrons).
+var DefaultPermissions = []string{PermissionBooksRead, PermissionAuthorsRead}
+
+// Permissions holds the permission codes for a single user.
+type Permissions []string
+
+// Include checks whether the Permissions slice contains a specific code.
+func (p Permissions) Include(code string) bool {
+	for i := range p {
+		if code == p[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionModel Define a struct type which wraps a sql.DB connection pool, or a
+// sql.Tx when obtained from Models.WithTx.
+type PermissionModel struct {
+	DB      Querier
+	Timeout time.Duration
+}
+
+// GetAllForUser returns all permission codes for a specific user.
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int) (_ Permissions, err error) {
+	defer wrapQueryError(ctx, &err)
+
+	query := `
+		SELECT permissions.code
+		FROM public.permissions
+		INNER JOIN public.users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var permissions Permissions
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// AddForUser grants the provided permission codes to a specific user.
+func (m PermissionModel) AddForUser(ctx context.Context, userID int, codes ...string) (err error) {
+	defer wrapQueryError(ctx, &err)
+
+	query := `
+		INSERT INTO public.users_permissions
+		SELECT $1, permissions.id FROM public.permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+
+	return err
+}
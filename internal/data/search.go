@@ -0,0 +1,26 @@
+package data
+
+// Search result types, reported in SearchResult.Type.
+const (
+	SearchTypeBook   = "book"
+	SearchTypeAuthor = "author"
+)
+
+// SearchResult is a single full-text search hit. Exactly one of Book and
+// Author is set, according to Type. Snippet is HTML: the matching text,
+// escaped, with the matched terms wrapped in <b></b>.
+type SearchResult struct {
+	Type    string  `json:"type"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+	Book    *Book   `json:"book,omitempty"`
+	Author  *Author `json:"author,omitempty"`
+}
+
+// escapeHTML wraps the SQL text expression expr so that it is HTML-escaped,
+// like html.EscapeString. ts_headline copies its input verbatim, so stored
+// text must be escaped before the <b></b> markers are added.
+func escapeHTML(expr string) string {
+	return `replace(replace(replace(replace(replace(` + expr +
+		`, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;'), '''', '&#39;')`
+}
@@ -0,0 +1,106 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"time"
+
+	"github.com/am-silex/go_library/internal/validator"
+)
+
+// ScopeAuthentication Define constants for the token scope.
+const (
+	ScopeAuthentication = "authentication"
+)
+
+// Token holds the data for an individual token. Only the hash is stored in
+// the database, the plaintext is sent to the client once.
+type Token struct {
+	Plaintext string    `json:"token"`
+	Hash      []byte    `json:"-"`
+	UserID    int       `json:"-"`
+	Expiry    time.Time `json:"expiry"`
+	Scope     string    `json:"-"`
+}
+
+func generateToken(userID int, ttl time.Duration, scope string) (*Token, error) {
+	token := &Token{
+		UserID: userID,
+		Expiry: time.Now().Add(ttl),
+		Scope:  scope,
+	}
+
+	// 16 random bytes give us a 26 characters long base32 plaintext.
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+
+	return token, nil
+}
+
+func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
+	v.Check(tokenPlaintext != "", "token", "must be provided")
+	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+}
+
+// TokenModel Define a struct type which wraps a sql.DB connection pool, or a
+// sql.Tx when obtained from Models.WithTx.
+type TokenModel struct {
+	DB      Querier
+	Timeout time.Duration
+}
+
+// New generates a new token and inserts it into the tokens table.
+func (m TokenModel) New(ctx context.Context, userID int, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+// Insert adds the data for a specific token to the tokens table.
+func (m TokenModel) Insert(ctx context.Context, token *Token) (err error) {
+	defer wrapQueryError(ctx, &err)
+
+	query := `
+		INSERT INTO public.tokens (hash, user_id, expiry, scope)
+		VALUES ($1, $2, $3, $4)`
+
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+
+	return err
+}
+
+// DeleteAllForUser deletes all tokens for a specific user and scope.
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int) (err error) {
+	defer wrapQueryError(ctx, &err)
+
+	query := `
+		DELETE FROM public.tokens
+		WHERE scope = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, scope, userID)
+
+	return err
+}
@@ -1,25 +1,119 @@
 package data
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
 
-type Transactions struct {
-	DB *sql.DB
+	"github.com/lib/pq"
+)
+
+// DefaultTxRetries is how many times WithTx runs a transaction again after
+// a serialization failure or a deadlock.
+const DefaultTxRetries = 3
+
+// TxOptions configures a transaction run by Models.WithTxOptions.
+type TxOptions struct {
+	// Isolation is the isolation level, sql.LevelDefault leaves the
+	// server's default (READ COMMITTED).
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+
+	// MaxRetries overrides DefaultTxRetries when positive; a negative
+	// value disables retries.
+	MaxRetries int
 }
 
-func (service Transactions) Create() (tx *sql.Tx, err error) {
+// WithTx runs fn in a transaction with the default options, see
+// WithTxOptions.
+func (m Models) WithTx(ctx context.Context, fn func(tx Models) error) error {
+	return m.WithTxOptions(ctx, TxOptions{}, fn)
+}
 
-	tx, err = service.DB.Begin()
-	if err != nil {
-		return nil, err
+// WithTxOptions runs fn with copies of the models bound to a new
+// transaction. The transaction is committed if fn returns nil and rolled
+// back if it returns an error or panics; the error, or panic, is passed on.
+//
+// When the transaction fails with a serialization failure or a deadlock,
+// which PostgreSQL expects clients to retry, fn is run again in a new
+// transaction. It must therefore not keep state from a previous attempt,
+// such as versions bumped by an Update that was rolled back.
+//
+// Called on models already bound to a transaction, fn simply joins it and
+// opts are ignored.
+func (m Models) WithTxOptions(ctx context.Context, opts TxOptions, fn func(tx Models) error) error {
+	if m.tx != nil {
+		return fn(m)
 	}
 
-	return tx, nil
+	retries := opts.MaxRetries
+	if retries == 0 {
+		retries = DefaultTxRetries
+	}
+
+	backoff := 10 * time.Millisecond
+
+	for attempt := 0; ; attempt++ {
+		err := m.runTx(ctx, opts, fn)
+		if err == nil || attempt >= retries || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
 }
 
-func (service Transactions) Commit(tx *sql.Tx) error {
+func (m Models) runTx(ctx context.Context, opts TxOptions, fn func(tx Models) error) (err error) {
+	defer wrapQueryError(ctx, &err)
+
+	tx, err := m.db.BeginTx(ctx, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	if err != nil {
+		return err
+	}
+
+	// A panic in fn must not leave the transaction, and its connection,
+	// open; it is re-raised once rolled back.
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	txModels := m.using(tx)
+	txModels.tx = tx
+
+	err = fn(txModels)
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rollbackErr)
+		}
+		return err
+	}
+
 	return tx.Commit()
 }
 
-func (service Transactions) Rollback(tx *sql.Tx) error {
-	return tx.Rollback()
+// retryable reports whether err is a PostgreSQL serialization failure or
+// deadlock, after which the whole transaction can be retried.
+func retryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	switch pqErr.Code {
+	case "40001", "40P01":
+		return true
+	default:
+		return false
+	}
 }
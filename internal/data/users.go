@@ -0,0 +1,211 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/am-silex/go_library/internal/validator"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrDuplicateEmail Define a custom ErrDuplicateEmail error.
+var (
+	ErrDuplicateEmail = errors.New("duplicate email")
+)
+
+// AnonymousUser represents a request without an authentication token.
+var AnonymousUser = &User{}
+
+type User struct {
+	ID        int       `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Password  password  `json:"-"`
+}
+
+// IsAnonymous checks if a User instance is the AnonymousUser.
+func (u *User) IsAnonymous() bool {
+	return u == AnonymousUser
+}
+
+// password holds the plaintext (if known) and the bcrypt hash of a password.
+// The plaintext is a pointer so that we can tell "not set" apart from "".
+type password struct {
+	plaintext *string
+	hash      []byte
+}
+
+// Set calculates the bcrypt hash of a plaintext password and stores both
+// the hash and the plaintext versions in the struct.
+func (p *password) Set(plaintextPassword string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	if err != nil {
+		return err
+	}
+
+	p.plaintext = &plaintextPassword
+	p.hash = hash
+
+	return nil
+}
+
+// Matches checks whether the provided plaintext password matches the
+// hashed password stored in the struct.
+func (p *password) Matches(plaintextPassword string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func ValidateEmail(v *validator.Validator, email string) {
+	v.Check(email != "", "email", "must be provided")
+	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
+}
+
+func ValidatePasswordPlaintext(v *validator.Validator, password string) {
+	v.Check(password != "", "password", "must be provided")
+	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
+	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+}
+
+func ValidateUser(v *validator.Validator, user *User) {
+	v.Check(user.Name != "", "name", "must be provided")
+	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
+
+	ValidateEmail(v, user.Email)
+
+	if user.Password.plaintext != nil {
+		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+	}
+
+	// If the password hash is ever nil, this will be due to a logic error in
+	// our codebase, not a problem with the data the client provided.
+	if user.Password.hash == nil {
+		panic("missing password hash for user")
+	}
+}
+
+// UserModel Define a struct type which wraps a sql.DB connection pool, or a
+// sql.Tx when obtained from Models.WithTx.
+type UserModel struct {
+	DB      Querier
+	Timeout time.Duration
+}
+
+// Insert The method accepts a pointer to a user struct, which should contain
+// the data for the new record.
+func (m UserModel) Insert(ctx context.Context, user *User) (err error) {
+	defer wrapQueryError(ctx, &err)
+
+	query := `
+		INSERT INTO public.users (name, email, password_hash)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`
+
+	args := []interface{}{user.Name, user.Email, user.Password.hash}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt)
+
+	if err != nil {
+		switch {
+		case violatedConstraint(err) == "users_email_key":
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetByEmail fetches a specific record from the users table.
+func (m UserModel) GetByEmail(ctx context.Context, email string) (_ *User, err error) {
+	defer wrapQueryError(ctx, &err)
+
+	query := `
+		SELECT id, created_at, name, email, password_hash
+		FROM public.users
+		WHERE email = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, email).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// GetForToken fetches the user owning a non-expired token with the given
+// scope and plaintext value.
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (_ *User, err error) {
+	defer wrapQueryError(ctx, &err)
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash
+		FROM public.users
+		INNER JOIN public.tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3`
+
+	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
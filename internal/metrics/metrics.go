@@ -0,0 +1,324 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are histogram buckets, in seconds, suited to request and query
+// latencies.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and writes them in the Prometheus text exposition
+// format. Metrics are registered once at startup; recording values is safe
+// for concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// metric is one metric family, written with its HELP and TYPE lines.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes all metrics in registration order.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+
+	return cw.n, err
+}
+
+// Handler serves the metrics to a Prometheus scraper.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// desc is the name, help text and label names shared by every kind of
+// metric.
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) writeHeader(w *bufio.Writer) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, d.kind)
+}
+
+// labelPairs formats label values as name="value" pairs, extra pairs (such
+// as a histogram's le) are appended.
+func (d desc) labelPairs(values []string, extra ...string) string {
+	var pairs []string
+	for i, value := range values {
+		pairs = append(pairs, d.labels[i]+`="`+escapeLabel(value)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// series is a set of values indexed by their label values, kept sorted on
+// output so that scrapes are stable.
+type series[T any] struct {
+	mu     sync.Mutex
+	values map[string]*T
+	labels map[string][]string
+}
+
+func (s *series[T]) get(d desc, values []string, init func() *T) *T {
+	key := d.key(values)
+
+	if s.values == nil {
+		s.values = make(map[string]*T)
+		s.labels = make(map[string][]string)
+	}
+
+	v, ok := s.values[key]
+	if !ok {
+		v = init()
+		s.values[key] = v
+		s.labels[key] = append([]string(nil), values...)
+	}
+	return v
+}
+
+func (s *series[T]) each(fn func(labels []string, v *T)) {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fn(s.labels[key], s.values[key])
+	}
+}
+
+// Counter is a value that only goes up, partitioned by labels.
+type Counter struct {
+	desc
+	series series[float64]
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help, kind: "counter", labels: labels}}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter by delta, which must not be negative.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+
+	c.series.mu.Lock()
+	defer c.series.mu.Unlock()
+	*c.series.get(c.desc, labelValues, newFloat) += delta
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.series.mu.Lock()
+	defer c.series.mu.Unlock()
+
+	c.writeHeader(w)
+	c.series.each(func(labels []string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(labels), formatFloat(*v))
+	})
+}
+
+// Gauge is a value that can go up and down, partitioned by labels.
+type Gauge struct {
+	desc
+	series series[float64]
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: desc{name: name, help: help, kind: "gauge", labels: labels}}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.series.mu.Lock()
+	defer g.series.mu.Unlock()
+	*g.series.get(g.desc, labelValues, newFloat) = value
+}
+
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.series.mu.Lock()
+	defer g.series.mu.Unlock()
+	*g.series.get(g.desc, labelValues, newFloat) += delta
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.series.mu.Lock()
+	defer g.series.mu.Unlock()
+
+	g.writeHeader(w)
+	g.series.each(func(labels []string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelPairs(labels), formatFloat(*v))
+	})
+}
+
+// funcMetric reads its value from a function at scrape time, for values
+// kept elsewhere such as the sql.DB pool statistics.
+type funcMetric struct {
+	desc
+	fn func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by fn.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{desc: desc{name: name, help: help, kind: "gauge"}, fn: fn})
+}
+
+// NewCounterFunc registers a counter whose value is returned by fn, which
+// must never decrease.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{desc: desc{name: name, help: help, kind: "counter"}, fn: fn})
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	f.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", f.name, formatFloat(f.fn()))
+}
+
+// Histogram counts observations into cumulative buckets, partitioned by
+// labels.
+type Histogram struct {
+	desc
+	buckets []float64
+	series  series[histogramValue]
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds,
+// which must be sorted in increasing order. The +Inf bucket is implied.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: %s buckets are not sorted", name))
+	}
+
+	h := &Histogram{
+		desc:    desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+	}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+
+	v := h.series.get(h.desc, labelValues, func() *histogramValue {
+		return &histogramValue{counts: make([]uint64, len(h.buckets))}
+	})
+
+	for i, upper := range h.buckets {
+		if value <= upper {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+
+	h.writeHeader(w)
+	h.series.each(func(labels []string, v *histogramValue) {
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(labels, "le", formatFloat(upper)), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(labels, "le", "+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(labels), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(labels), v.count)
+	})
+}
+
+func newFloat() *float64 {
+	return new(float64)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,202 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// expose returns the text exposition of r.
+func expose(t *testing.T, r *Registry) string {
+	t.Helper()
+
+	var b strings.Builder
+	n, err := r.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(b.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, b.Len())
+	}
+	return b.String()
+}
+
+func checkExposition(t *testing.T, got, want string) {
+	t.Helper()
+
+	want = strings.TrimPrefix(want, "\n")
+	if got != want {
+		t.Errorf("exposition mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests served.", "route", "status")
+
+	c.Inc("GET /books", "200")
+	c.Inc("GET /books", "200")
+	c.Add(0.5, "GET /authors", "404")
+
+	checkExposition(t, expose(t, r), `
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="GET /authors",status="404"} 0.5
+requests_total{route="GET /books",status="200"} 2
+`)
+}
+
+func TestCounterPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests served.", "route")
+
+	tests := []struct {
+		name string
+		fn   func()
+	}{
+		{"negative delta", func() { c.Add(-1, "x") }},
+		{"missing label value", func() { c.Inc() }},
+		{"extra label value", func() { c.Inc("x", "y") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic")
+				}
+			}()
+			tt.fn()
+		})
+	}
+}
+
+func TestGauge(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGauge("in_flight", "Requests in flight.")
+
+	g.Add(3)
+	g.Add(-1)
+
+	checkExposition(t, expose(t, r), `
+# HELP in_flight Requests in flight.
+# TYPE in_flight gauge
+in_flight 2
+`)
+
+	g.Set(7)
+
+	checkExposition(t, expose(t, r), `
+# HELP in_flight Requests in flight.
+# TYPE in_flight gauge
+in_flight 7
+`)
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("query_seconds", "Query durations.", []float64{0.1, 1}, "model", "method")
+
+	h.Observe(0.05, "books", "get")
+	h.Observe(0.1, "books", "get")
+	h.Observe(0.5, "books", "get")
+	h.Observe(3, "books", "get")
+	h.Observe(2, "authors", "get_all")
+
+	checkExposition(t, expose(t, r), `
+# HELP query_seconds Query durations.
+# TYPE query_seconds histogram
+query_seconds_bucket{model="authors",method="get_all",le="0.1"} 0
+query_seconds_bucket{model="authors",method="get_all",le="1"} 0
+query_seconds_bucket{model="authors",method="get_all",le="+Inf"} 1
+query_seconds_sum{model="authors",method="get_all"} 2
+query_seconds_count{model="authors",method="get_all"} 1
+query_seconds_bucket{model="books",method="get",le="0.1"} 2
+query_seconds_bucket{model="books",method="get",le="1"} 3
+query_seconds_bucket{model="books",method="get",le="+Inf"} 4
+query_seconds_sum{model="books",method="get"} 3.65
+query_seconds_count{model="books",method="get"} 4
+`)
+}
+
+func TestHistogramUnsortedBuckets(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+
+	NewRegistry().NewHistogram("h", "Help.", []float64{1, 0.5})
+}
+
+func TestEscaping(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("escaped_total", "Help with a \\ backslash\nand a newline.", "path")
+
+	c.Inc(`C:\books "new"` + "\nline")
+
+	checkExposition(t, expose(t, r), `
+# HELP escaped_total Help with a \\ backslash\nand a newline.
+# TYPE escaped_total counter
+escaped_total{path="C:\\books \"new\"\nline"} 1
+`)
+}
+
+func TestFuncMetrics(t *testing.T) {
+	r := NewRegistry()
+	open := 3.0
+	r.NewGaugeFunc("open_connections", "Open connections.", func() float64 { return open })
+	r.NewCounterFunc("wait_seconds_total", "Time waited.", func() float64 { return 1.5 })
+
+	open = 5
+
+	checkExposition(t, expose(t, r), `
+# HELP open_connections Open connections.
+# TYPE open_connections gauge
+open_connections 5
+# HELP wait_seconds_total Time waited.
+# TYPE wait_seconds_total counter
+wait_seconds_total 1.5
+`)
+}
+
+func TestFormatFloat(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  string
+	}{
+		{0, "0"},
+		{0.005, "0.005"},
+		{2.5, "2.5"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+
+	for _, tt := range tests {
+		if got := formatFloat(tt.value); got != tt.want {
+			t.Errorf("formatFloat(%v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Requests served.").Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if got, want := w.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+
+	checkExposition(t, w.Body.String(), `
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total 1
+`)
+}
@@ -0,0 +1,349 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// files holds the SQL migrations. Each version has an up and a down file
+// named <version>_<name>.up.sql and <version>_<name>.down.sql, and may have
+// a <version>_<name>.check.sql run just before the up file. Checks let a
+// migration report data it can't handle without editing the up file of a
+// version that databases may already have applied.
+//
+//go:embed sql/*.sql
+var files embed.FS
+
+// lockID is the key of the PostgreSQL advisory lock taken while migrating,
+// so that two instances starting at once don't apply the same migration.
+const lockID = 7_531_908_224
+
+// ErrNoChange Define a custom ErrNoChange error.
+var (
+	ErrNoChange       = errors.New("no change")
+	ErrUnknownVersion = errors.New("unknown migration version")
+)
+
+// Migration is a single versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Check   string
+	Up      string
+	Down    string
+}
+
+// Status reports whether a migration has been applied, and when.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrator applies the embedded migrations to a database. Applied versions
+// are recorded in the schema_migrations table.
+type Migrator struct {
+	DB         *sql.DB
+	migrations []Migration
+}
+
+// New loads the embedded migrations, ordered by version.
+func New(db *sql.DB) (*Migrator, error) {
+	byVersion := map[int]*Migration{}
+
+	entries, err := fs.ReadDir(files, "sql")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".check.sql"):
+			direction = "check"
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s: unexpected file name", name)
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		versionPart, title, found := strings.Cut(base, "_")
+		if !found {
+			return nil, fmt.Errorf("migration %s: missing name", name)
+		}
+
+		version, err := strconv.Atoi(versionPart)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s: invalid version", name)
+		}
+
+		body, err := files.ReadFile(path.Join("sql", name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: title}
+			byVersion[version] = m
+		}
+		if m.Name != title {
+			return nil, fmt.Errorf("migration %d: conflicting names %q and %q", version, m.Name, title)
+		}
+
+		switch direction {
+		case "check":
+			m.Check = string(body)
+		case "up":
+			m.Up = string(body)
+		case "down":
+			m.Down = string(body)
+		}
+	}
+
+	migrator := &Migrator{DB: db}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d: both up and down files are required", m.Version)
+		}
+		migrator.migrations = append(migrator.migrations, *m)
+	}
+
+	sort.Slice(migrator.migrations, func(i, j int) bool {
+		return migrator.migrations[i].Version < migrator.migrations[j].Version
+	})
+
+	return migrator, nil
+}
+
+// Latest returns the highest known migration version.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies all pending migrations.
+func (m *Migrator) Up() error {
+	return m.Goto(m.Latest())
+}
+
+// Down reverts the most recently applied migration.
+func (m *Migrator) Down() error {
+	return m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		current, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		if current == 0 {
+			return ErrNoChange
+		}
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			if m.migrations[i].Version == current {
+				return m.revert(ctx, conn, m.migrations[i])
+			}
+		}
+
+		return fmt.Errorf("%w: database is at version %d", ErrUnknownVersion, current)
+	})
+}
+
+// Goto migrates up or down until the database is at the given version.
+// Version 0 reverts every migration.
+func (m *Migrator) Goto(version int) error {
+	if version != 0 && !m.known(version) {
+		return fmt.Errorf("%w: %d", ErrUnknownVersion, version)
+	}
+
+	return m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		current, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		if current != 0 && !m.known(current) {
+			return fmt.Errorf("%w: database is at version %d", ErrUnknownVersion, current)
+		}
+
+		switch {
+		case version > current:
+			for _, migration := range m.migrations {
+				if migration.Version > current && migration.Version <= version {
+					if err := m.apply(ctx, conn, migration); err != nil {
+						return err
+					}
+				}
+			}
+		case version < current:
+			for i := len(m.migrations) - 1; i >= 0; i-- {
+				migration := m.migrations[i]
+				if migration.Version <= current && migration.Version > version {
+					if err := m.revert(ctx, conn, migration); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			return ErrNoChange
+		}
+
+		return nil
+	})
+}
+
+// Status lists every known migration along with when it was applied.
+func (m *Migrator) Status() ([]Status, error) {
+	var statuses []Status
+
+	err := m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM public.schema_migrations`)
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close()
+
+		applied := map[int]time.Time{}
+		for rows.Next() {
+			var version int
+			var appliedAt time.Time
+
+			if err := rows.Scan(&version, &appliedAt); err != nil {
+				return err
+			}
+			applied[version] = appliedAt
+		}
+
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			status := Status{Migration: migration}
+			if appliedAt, ok := applied[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+func (m *Migrator) known(version int) bool {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// withLock runs fn on a dedicated connection holding the migrations
+// advisory lock, after making sure the schema_migrations table exists.
+func (m *Migrator) withLock(fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockID)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS public.schema_migrations
+		(
+			version    bigint primary key,
+			name       varchar                     not null,
+			applied_at timestamp(0) with time zone not null default now()
+		)`)
+	if err != nil {
+		return err
+	}
+
+	return fn(ctx, conn)
+}
+
+func currentVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var version int
+
+	err := conn.QueryRowContext(ctx, `SELECT coalesce(max(version), 0) FROM public.schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// apply runs the check and up scripts and records the version in one
+// transaction, so a failing migration leaves no trace.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	return inTx(ctx, conn, func(tx *sql.Tx) error {
+		if migration.Check != "" {
+			if _, err := tx.ExecContext(ctx, migration.Check); err != nil {
+				return fmt.Errorf("migration %d_%s check: %w", migration.Version, migration.Name, err)
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+			return fmt.Errorf("migration %d_%s up: %w", migration.Version, migration.Name, err)
+		}
+
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO public.schema_migrations (version, name) VALUES ($1, $2)`,
+			migration.Version, migration.Name)
+		return err
+	})
+}
+
+// revert runs the down script and removes the version in one transaction.
+func (m *Migrator) revert(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	return inTx(ctx, conn, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+			return fmt.Errorf("migration %d_%s down: %w", migration.Version, migration.Name, err)
+		}
+
+		_, err := tx.ExecContext(ctx,
+			`DELETE FROM public.schema_migrations WHERE version = $1`,
+			migration.Version)
+		return err
+	})
+}
+
+func inTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,2 @@
+drop table if exists public.books;
+drop table if exists public.authors;
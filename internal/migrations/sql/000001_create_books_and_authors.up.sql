@@ -1,4 +1,6 @@
-create table public.books
+-- Mirrors the schema of the former Docker/init.sql, so databases created
+-- from it can be brought under migrations without changes.
+create table if not exists public.books
 (
     id       serial,
     title    varchar,
@@ -7,10 +9,7 @@ create table public.books
     isbn     varchar
 );
 
-alter table public.books
-    owner to postgres;
-
-create table public.authors
+create table if not exists public.authors
 (
     id            serial,
     first_name    varchar,
@@ -18,7 +17,3 @@ create table public.authors
     bio           varchar,
     date_of_birth integer
 );
-
-alter table public.authors
-    owner to postgres;
-
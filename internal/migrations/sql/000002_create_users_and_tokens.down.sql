@@ -0,0 +1,2 @@
+drop table if exists public.tokens;
+drop table if exists public.users;
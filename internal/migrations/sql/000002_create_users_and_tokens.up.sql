@@ -0,0 +1,18 @@
+create extension if not exists citext;
+
+create table if not exists public.users
+(
+    id            bigserial primary key,
+    created_at    timestamp(0) with time zone not null default now(),
+    name          varchar                     not null,
+    email         citext unique               not null,
+    password_hash bytea                       not null
+);
+
+create table if not exists public.tokens
+(
+    hash    bytea primary key,
+    user_id bigint                      not null references public.users on delete cascade,
+    expiry  timestamp(0) with time zone not null,
+    scope   varchar                     not null
+);
@@ -0,0 +1,2 @@
+drop table if exists public.users_permissions;
+drop table if exists public.permissions;
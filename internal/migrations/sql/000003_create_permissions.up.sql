@@ -0,0 +1,19 @@
+create table if not exists public.permissions
+(
+    id   bigserial primary key,
+    code varchar unique not null
+);
+
+create table if not exists public.users_permissions
+(
+    user_id       bigint not null references public.users on delete cascade,
+    permission_id bigint not null references public.permissions on delete cascade,
+    primary key (user_id, permission_id)
+);
+
+insert into public.permissions (code)
+values ('books:read'),
+       ('books:write'),
+       ('authors:read'),
+       ('authors:write')
+on conflict do nothing;
@@ -0,0 +1,5 @@
+drop index if exists public.authors_search_idx;
+alter table public.authors drop column if exists search;
+
+drop index if exists public.books_search_idx;
+alter table public.books drop column if exists search;
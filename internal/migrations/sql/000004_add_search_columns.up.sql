@@ -0,0 +1,14 @@
+alter table public.books
+    add column if not exists search tsvector generated always as (
+        setweight(to_tsvector('simple', coalesce(title, '')), 'A')
+        ) stored;
+
+create index if not exists books_search_idx on public.books using gin (search);
+
+alter table public.authors
+    add column if not exists search tsvector generated always as (
+        setweight(to_tsvector('simple', coalesce(first_name, '') || ' ' || coalesce(last_name, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(bio, '')), 'B')
+        ) stored;
+
+create index if not exists authors_search_idx on public.authors using gin (search);
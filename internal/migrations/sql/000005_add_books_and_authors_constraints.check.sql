@@ -0,0 +1,68 @@
+-- Databases created from the former Docker/init.sql may hold rows that the
+-- constraints added by migration 5 reject. They can't be fixed up without
+-- guessing, so the migration stops with a message listing them (at most 20
+-- ids each) and can be run again once they are corrected. See "Upgrading an existing
+-- database" in the README.
+do $$
+declare
+    problems text[] := '{}';
+    problem  text;
+begin
+    select format('authors %s (%s rows) lack first_name, last_name or date_of_birth',
+                  array_to_string((array_agg(id order by id))[1:20], ', '), count(*))
+    into problem
+    from public.authors
+    where first_name is null or last_name is null or date_of_birth is null
+    having count(*) > 0;
+    problems := problems || problem;
+
+    select format('books %s (%s rows) lack title, authorid or isbn',
+                  array_to_string((array_agg(id order by id))[1:20], ', '), count(*))
+    into problem
+    from public.books
+    where title is null or authorid is null or isbn is null
+    having count(*) > 0;
+    problems := problems || problem;
+
+    select format('books %s (%s rows) reference authors that don''t exist',
+                  array_to_string((array_agg(b.id order by b.id))[1:20], ', '), count(*))
+    into problem
+    from public.books b
+    where b.authorid is not null
+      and not exists (select 1 from public.authors a where a.id = b.authorid)
+    having count(*) > 0;
+    problems := problems || problem;
+
+    select 'books share an ISBN: ' || string_agg(format('%s (books %s)', isbn, ids), ', ')
+    into problem
+    from (select isbn, array_to_string((array_agg(id order by id))[1:20], ', ') as ids
+          from public.books
+          where isbn is not null
+          group by isbn
+          having count(*) > 1
+          limit 20) d
+    having count(*) > 0;
+    problems := problems || problem;
+
+    select 'authors share an id: ' || string_agg(id::text, ', ')
+    into problem
+    from (select id from public.authors group by id having count(*) > 1 limit 20) d
+    having count(*) > 0;
+    problems := problems || problem;
+
+    select 'books share an id: ' || string_agg(id::text, ', ')
+    into problem
+    from (select id from public.books group by id having count(*) > 1 limit 20) d
+    having count(*) > 0;
+    problems := problems || problem;
+
+    -- Concatenating a NULL leaves a NULL element when a check found nothing.
+    problems := array_remove(problems, null);
+
+    if cardinality(problems) > 0 then
+        raise exception 'cannot add the books and authors constraints, fix these rows and run the migration again: %',
+            array_to_string(problems, '; ');
+    end if;
+end
+$$;
+
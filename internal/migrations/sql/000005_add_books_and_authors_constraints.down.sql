@@ -0,0 +1,19 @@
+drop index if exists public.books_authorid_idx;
+
+alter table public.books
+    drop constraint if exists books_authorid_fkey,
+    drop constraint if exists books_isbn_key,
+    drop constraint if exists books_pkey,
+    alter column title drop not null,
+    alter column authorid drop not null,
+    alter column year drop default,
+    alter column year drop not null,
+    alter column isbn drop not null;
+
+alter table public.authors
+    drop constraint if exists authors_pkey,
+    alter column first_name drop not null,
+    alter column last_name drop not null,
+    alter column bio drop default,
+    alter column bio drop not null,
+    alter column date_of_birth drop not null;
@@ -0,0 +1,24 @@
+-- The API scans bio and year into non-nullable fields, so existing NULLs
+-- are replaced with the values it already treats as "empty".
+update public.authors set bio = '' where bio is null;
+update public.books set year = 0 where year is null;
+
+alter table public.authors
+    add primary key (id),
+    alter column first_name set not null,
+    alter column last_name set not null,
+    alter column bio set default '',
+    alter column bio set not null,
+    alter column date_of_birth set not null;
+
+alter table public.books
+    add primary key (id),
+    alter column title set not null,
+    alter column authorid set not null,
+    alter column year set default 0,
+    alter column year set not null,
+    alter column isbn set not null,
+    add constraint books_isbn_key unique (isbn),
+    add constraint books_authorid_fkey foreign key (authorid) references public.authors (id) on delete restrict;
+
+create index if not exists books_authorid_idx on public.books (authorid);
@@ -0,0 +1,5 @@
+alter table public.authors
+    drop column if exists version;
+
+alter table public.books
+    drop column if exists version;
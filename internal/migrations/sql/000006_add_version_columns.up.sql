@@ -0,0 +1,5 @@
+alter table public.books
+    add column if not exists version integer not null default 1;
+
+alter table public.authors
+    add column if not exists version integer not null default 1;
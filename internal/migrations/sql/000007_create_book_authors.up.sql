@@ -0,0 +1,19 @@
+-- A book can have several authors, each with a role, listed in order.
+-- books.authorid stays as the book's primary author for older clients.
+create table if not exists public.book_authors
+(
+    book_id   integer not null references public.books on delete cascade,
+    author_id integer not null,
+    role      varchar not null default 'author',
+    position  integer not null default 1,
+    primary key (book_id, author_id, role),
+    constraint book_authors_author_id_fkey foreign key (author_id) references public.authors (id) on delete restrict,
+    constraint book_authors_role_check check (role in ('author', 'editor', 'translator', 'illustrator'))
+);
+
+create index if not exists book_authors_author_id_idx on public.book_authors (author_id);
+
+insert into public.book_authors (book_id, author_id, role, position)
+select id, authorid, 'author', 1
+from public.books
+on conflict do nothing;
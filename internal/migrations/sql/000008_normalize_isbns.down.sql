@@ -0,0 +1,2 @@
+-- The original spelling of the ISBNs is not kept, they stay normalized.
+select 1;
@@ -0,0 +1,23 @@
+-- ISBNs are stored without separators and with an upper-case X, so that
+-- books_isbn_key catches the same ISBN written differently. Books whose
+-- ISBNs only differ by their spelling must be merged by hand first.
+do $$
+declare
+    duplicates text;
+begin
+    select string_agg(format('%s (books %s)', isbn, ids), ', ')
+    into duplicates
+    from (select upper(translate(isbn, '- ', '')) as isbn, string_agg(id::text, ', ' order by id) as ids
+          from public.books
+          group by 1
+          having count(*) > 1) d;
+
+    if duplicates is not null then
+        raise exception 'books with the same ISBN must be merged before normalizing ISBNs: %', duplicates;
+    end if;
+end
+$$;
+
+update public.books
+set isbn = upper(translate(isbn, '- ', ''))
+where isbn <> upper(translate(isbn, '- ', ''));
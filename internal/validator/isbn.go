@@ -0,0 +1,65 @@
+package validator
+
+import (
+	"strings"
+)
+
+// isbnSeparators are the characters allowed between the digits of an ISBN.
+var isbnSeparators = strings.NewReplacer("-", "", " ", "")
+
+// NormalizeISBN removes the separators from s and upper-cases the 'x' check
+// digit of an ISBN-10, so that all spellings of an ISBN compare equal.
+func NormalizeISBN(s string) string {
+	return strings.ToUpper(isbnSeparators.Replace(s))
+}
+
+// ValidISBN returns true if s is an ISBN-10 or ISBN-13 with a correct check
+// digit. Hyphens and spaces between the digits are ignored.
+func ValidISBN(s string) bool {
+	s = NormalizeISBN(s)
+
+	switch len(s) {
+	case 10:
+		return validISBN10(s)
+	case 13:
+		return validISBN13(s)
+	default:
+		return false
+	}
+}
+
+// validISBN10 checks that the digits, weighted 10 down to 1, sum to a
+// multiple of 11. The check digit may be 'X', standing for 10.
+func validISBN10(s string) bool {
+	sum := 0
+	for i := 0; i < 10; i++ {
+		var digit int
+		switch {
+		case s[i] >= '0' && s[i] <= '9':
+			digit = int(s[i] - '0')
+		case i == 9 && s[i] == 'X':
+			digit = 10
+		default:
+			return false
+		}
+		sum += digit * (10 - i)
+	}
+	return sum%11 == 0
+}
+
+// validISBN13 checks that the digits, alternately weighted 1 and 3, sum to
+// a multiple of 10.
+func validISBN13(s string) bool {
+	sum := 0
+	for i := 0; i < 13; i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+		digit := int(s[i] - '0')
+		if i%2 == 1 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,56 @@
+package validator
+
+import "testing"
+
+func TestValidISBN(t *testing.T) {
+	tests := []struct {
+		name string
+		isbn string
+		want bool
+	}{
+		{"ISBN-10", "0306406152", true},
+		{"ISBN-10 with hyphens", "0-306-40615-2", true},
+		{"ISBN-10 with spaces", "0 306 40615 2", true},
+		{"ISBN-10 with X check digit", "080442957X", true},
+		{"ISBN-10 with lower-case x", "0-8044-2957-x", true},
+		{"ISBN-10 bad check digit", "0306406153", false},
+		{"ISBN-10 X not last", "080442X957", false},
+		{"ISBN-10 letter", "03064A6152", false},
+		{"ISBN-13", "9780306406157", true},
+		{"ISBN-13 with hyphens", "978-0-306-40615-7", true},
+		{"ISBN-13 bad check digit", "9780306406158", false},
+		{"ISBN-13 with X", "978030640615X", false},
+		{"too short", "030640615", false},
+		{"between lengths", "03064061521", false},
+		{"too long", "97803064061570", false},
+		{"empty", "", false},
+		{"only separators", "- -", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidISBN(tt.isbn); got != tt.want {
+				t.Errorf("ValidISBN(%q) = %v, want %v", tt.isbn, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want string
+	}{
+		{"0306406152", "0306406152"},
+		{"0-306-40615-2", "0306406152"},
+		{"0 306 40615 2", "0306406152"},
+		{"0-8044-2957-x", "080442957X"},
+		{"978-0-306-40615-7", "9780306406157"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeISBN(tt.isbn); got != tt.want {
+			t.Errorf("NormalizeISBN(%q) = %q, want %q", tt.isbn, got, tt.want)
+		}
+	}
+}